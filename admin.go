@@ -0,0 +1,374 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const recentRequestsSize = 64
+
+// RecentRequest summarizes an exchange handled by a node
+type RecentRequest struct {
+	Time       time.Time     `json:"time"`
+	ClientAddr string        `json:"clientAddr"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Status     int           `json:"status"`   // Status sent to the client, or 0 if the connection was aborted
+	Duration   time.Duration `json:"duration"` // Time until the exchange was finished, in nanoseconds
+}
+
+// recentRequests is a ring buffer of the last exchanges handled by a node
+type recentRequests struct {
+	mu       sync.Mutex
+	requests []RecentRequest
+	next     int
+}
+
+func (rr *recentRequests) add(rc *RequestContext) {
+	request := RecentRequest{
+		Time:       rc.Start,
+		ClientAddr: rc.Request.RemoteAddr,
+		Method:     rc.Request.Method,
+		URL:        rc.Request.URL.String(),
+		Status:     rc.Status,
+		Duration:   time.Since(rc.Start),
+	}
+	if !rc.Request.URL.IsAbs() {
+		request.URL = "//" + rc.Request.Host + rc.Request.URL.String()
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if len(rr.requests) < recentRequestsSize {
+		rr.requests = append(rr.requests, request)
+		return
+	}
+
+	rr.requests[rr.next] = request
+	rr.next = (rr.next + 1) % recentRequestsSize
+}
+
+// RecentRequests returns the last exchanges handled by g, oldest first
+func (g *Goxxy) RecentRequests() []RecentRequest {
+	g.recent.mu.Lock()
+	defer g.recent.mu.Unlock()
+
+	requests := make([]RecentRequest, 0, len(g.recent.requests))
+	requests = append(requests, g.recent.requests[g.recent.next:]...)
+	return append(requests, g.recent.requests[:g.recent.next]...)
+}
+
+// Admin is an http.Handler exposing a JSON API to inspect and reconfigure a Goxxy tree while it serves traffic.
+// It should be served on a separate listener, not reachable by the clients of the proxy. Requests can be authenticated
+// with Token or Authorize. Modules registered with RegisterFileModule, which access files, cannot be added through it.
+//
+// Nodes are addressed by their path as in RequestContext.NodePath, e.g. /nodes/root/api/0. The following endpoints
+// are available:
+//
+//	GET    /tree                          Whole tree, with the matchers and modules of each node
+//	GET    /kinds                         Kinds of matchers and modules which can be added
+//	GET    /explain                       How the request described by the url, method and header parameters would
+//	                                      be routed, e.g. /explain?url=http://example.com/&header=Cookie:session=1
+//	GET    /nodes/{path}                  A single node
+//	GET    /nodes/{path}/requests         Last requests handled by the node
+//	POST   /nodes/{path}/enable           Enable the node
+//	POST   /nodes/{path}/disable          Disable the node, so neither it nor its children match any request
+//	POST   /nodes/{path}/matchers         Add a matcher, described as {"kind": "host", "params": {"host": "example.com"}}
+//	POST   /nodes/{path}/modules          Add a module, described in the same way. Conditions on the responses it
+//	                                      mangles can be set in when, as in goxxy.ResponseCondition
+//	DELETE /nodes/{path}/{list}/{index}   Remove an element from matchers, middlewares, manglers or frameManglers
+type Admin struct {
+	Token     string                   // If set, requests must carry it in an "Authorization: Bearer <Token>" header
+	Authorize func(*http.Request) bool // If set, requests for which it returns false are rejected
+
+	root func() *Goxxy
+}
+
+// NewAdmin returns an Admin operating on the tree rooted at root
+func NewAdmin(root *Goxxy) *Admin {
+	return &Admin{root: func() *Goxxy { return root }}
+}
+
+// NewAdminFunc returns an Admin operating on the tree returned by root, which is called on every request.
+// It is useful when the tree can be replaced, e.g. when config is reloaded.
+func NewAdminFunc(root func() *Goxxy) *Admin {
+	return &Admin{root: root}
+}
+
+// ListenAndServe serves the admin API on a separate listener
+func (a *Admin) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, a)
+}
+
+// AdminNode is the representation of a node returned by the admin API
+type AdminNode struct {
+	Path          string       `json:"path"`
+	Enabled       bool         `json:"enabled"`
+	Matchers      []string     `json:"matchers"`
+	Middlewares   []string     `json:"middlewares"`
+	Manglers      []string     `json:"manglers"`
+	FrameManglers []string     `json:"frameManglers"`
+	Children      []*AdminNode `json:"children,omitempty"`
+}
+
+// adminElement is the body expected when adding matchers and modules. Modules can be given conditions in When.
+type adminElement struct {
+	Kind   string             `json:"kind"`
+	Params json.RawMessage    `json:"params"`
+	When   *ResponseCondition `json:"when"`
+}
+
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/tree":
+		if r.Method != http.MethodGet {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		root := a.root()
+		writeJSON(rw, describeNode(root, root.label(-1), true))
+
+	case r.URL.Path == "/kinds":
+		if r.Method != http.MethodGet {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, map[string][]string{"matchers": MatcherKinds(), "modules": ModuleKinds()})
+
+	case r.URL.Path == "/explain":
+		if r.Method != http.MethodGet {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		req, err := explainRequest(r.URL.Query())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(rw, a.root().Explain(req))
+
+	case strings.HasPrefix(r.URL.Path, "/nodes/"):
+		a.serveNode(rw, r, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/nodes/"), "/"), "/"))
+
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+// authorized returns true if r carries a.Token, if set, and is accepted by a.Authorize, if set
+func (a *Admin) authorized(r *http.Request) bool {
+	if a.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(a.Token)) != 1 {
+			return false
+		}
+	}
+
+	return a.Authorize == nil || a.Authorize(r)
+}
+
+// serveNode handles requests under /nodes/. The node path is consumed greedily, so children take precedence over
+// actions with the same name.
+func (a *Admin) serveNode(rw http.ResponseWriter, r *http.Request, segments []string) {
+	root := a.root()
+	if segments[0] != root.label(-1) {
+		http.Error(rw, "node not found", http.StatusNotFound)
+		return
+	}
+
+	node, path := root, segments[:1]
+	segments = segments[1:]
+
+walk:
+	for len(segments) > 0 {
+		for i, child := range node.Children() {
+			if child.label(i) == segments[0] {
+				node, path = child, append(path, segments[0])
+				segments = segments[1:]
+				continue walk
+			}
+		}
+		break
+	}
+
+	nodePath := strings.Join(path, "/")
+	action := strings.Join(segments, "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(rw, describeNode(node, nodePath, false))
+
+	case action == "requests" && r.Method == http.MethodGet:
+		writeJSON(rw, node.RecentRequests())
+
+	case (action == "enable" || action == "disable") && r.Method == http.MethodPost:
+		node.SetEnabled(action == "enable")
+		writeJSON(rw, describeNode(node, nodePath, false))
+
+	case (action == "matchers" || action == "modules") && r.Method == http.MethodPost:
+		if err := addElement(node, action, r); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(rw, describeNode(node, nodePath, false))
+
+	case len(segments) == 2 && r.Method == http.MethodDelete:
+		if err := removeElement(node, segments[0], segments[1]); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, describeNode(node, nodePath, false))
+
+	default:
+		http.Error(rw, "unknown action "+r.Method+" "+action, http.StatusNotFound)
+	}
+}
+
+// explainRequest builds the synthetic request described by the parameters of an /explain call
+func explainRequest(params url.Values) (*http.Request, error) {
+	if params.Get("url") == "" {
+		return nil, fmt.Errorf("url parameter is required")
+	}
+
+	method := params.Get("method")
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, params.Get("url"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = req.URL.RequestURI()
+
+	for _, header := range params["header"] {
+		colon := strings.IndexByte(header, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid header %q", header)
+		}
+		req.Header.Add(strings.TrimSpace(header[:colon]), strings.TrimSpace(header[colon+1:]))
+	}
+
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	return req, nil
+}
+
+// addElement builds a matcher or a module as described in the body of r and adds it to node
+func addElement(node *Goxxy, list string, r *http.Request) error {
+	var element adminElement
+	if err := json.NewDecoder(r.Body).Decode(&element); err != nil {
+		return fmt.Errorf("error decoding body: %v", err)
+	}
+
+	decode := func(v interface{}) error {
+		if len(element.Params) == 0 {
+			return nil
+		}
+		return json.Unmarshal(element.Params, v)
+	}
+
+	if list == "matchers" {
+		matcher, err := NewMatcher(element.Kind, decode)
+		if err != nil {
+			return err
+		}
+		node.Match(matcher)
+		return nil
+	}
+
+	if IsFileModule(element.Kind) {
+		return fmt.Errorf("modules of kind %q access files and cannot be added through the admin API", element.Kind)
+	}
+
+	module, err := NewModule(element.Kind, decode)
+	if err != nil {
+		return err
+	}
+
+	if element.When != nil {
+		condition, err := element.When.Matcher()
+		if err != nil {
+			return err
+		}
+		return node.AddModuleWhen(condition, module)
+	}
+
+	return node.AddModule(module)
+}
+
+// removeElement removes the element at the given index of one of the lists of node
+func removeElement(node *Goxxy, list, index string) error {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return fmt.Errorf("invalid index %q", index)
+	}
+
+	switch list {
+	case "matchers":
+		return node.RemoveMatcher(i)
+	case "middlewares":
+		return node.RemoveMiddleware(i)
+	case "manglers":
+		return node.RemoveMangler(i)
+	case "frameManglers":
+		return node.RemoveFrameMangler(i)
+	}
+
+	return fmt.Errorf("unknown list %q", list)
+}
+
+// describeNode returns the AdminNode for g, including its descendants if recursive is true
+func describeNode(g *Goxxy, path string, recursive bool) *AdminNode {
+	node := &AdminNode{Path: path, Enabled: g.Enabled()}
+
+	for _, m := range g.Matchers() {
+		node.Matchers = append(node.Matchers, describe(m))
+	}
+	for _, mw := range g.Middlewares() {
+		node.Middlewares = append(node.Middlewares, describe(mw))
+	}
+	for _, mg := range g.Manglers() {
+		node.Manglers = append(node.Manglers, describe(mg))
+	}
+	for _, fm := range g.FrameManglers() {
+		node.FrameManglers = append(node.FrameManglers, describe(fm))
+	}
+
+	if recursive {
+		for i, child := range g.Children() {
+			node.Children = append(node.Children, describeNode(child, path+"/"+child.label(i), true))
+		}
+	}
+
+	return node
+}
+
+// describe returns a human-readable description of a matcher or module
+func describe(element interface{}) string {
+	if stringer, isStringer := element.(fmt.Stringer); isStringer {
+		return stringer.String()
+	}
+
+	return ModuleName(element)
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,203 @@
+package goxxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type headerModule struct {
+	Value string `json:"value"`
+}
+
+func (hm *headerModule) Mangle(response *http.Response) *http.Response {
+	response.Header.Set("X-Admin", hm.Value)
+	return response
+}
+
+func init() {
+	RegisterModule("test-header", func(decode Decoder) (interface{}, error) {
+		hm := &headerModule{}
+		return hm, decode(hm)
+	})
+	RegisterFileModule("test-file", func(decode Decoder) (interface{}, error) {
+		return &headerModule{}, nil
+	})
+}
+
+func adminRequest(t *testing.T, admin http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestAdmin(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	g := New()
+	api := g.Child()
+	api.Name = "api"
+	api.Match(HostMatcher("^nothing$"))
+	admin := NewAdmin(g)
+
+	rec := adminRequest(t, admin, http.MethodPost, "/nodes/root/api/matchers", `{"kind": "host", "params": {"host": "127.0.0.1"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Error adding matcher: %s", rec.Body.String())
+	}
+
+	rec = adminRequest(t, admin, http.MethodPost, "/nodes/root/api/modules", `{"kind": "test-header", "params": {"value": "yes"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Error adding module: %s", rec.Body.String())
+	}
+
+	proxied := httptest.NewRecorder()
+	g.ServeHTTP(proxied, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if proxied.Header().Get("X-Admin") != "yes" {
+		t.Error("Module added through the admin API was not applied")
+	}
+
+	var tree AdminNode
+	if err := json.Unmarshal(adminRequest(t, admin, http.MethodGet, "/tree", "").Body.Bytes(), &tree); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].Path != "root/api" || len(tree.Children[0].Matchers) != 2 ||
+		tree.Children[0].Manglers[0] != "goxxy.headerModule" {
+		t.Errorf("Unexpected tree %+v", tree.Children[0])
+	}
+
+	var requests []RecentRequest
+	json.Unmarshal(adminRequest(t, admin, http.MethodGet, "/nodes/root/api/requests", "").Body.Bytes(), &requests)
+	if len(requests) != 1 || requests[0].Status != http.StatusOK || requests[0].Method != http.MethodGet {
+		t.Errorf("Unexpected recent requests %+v", requests)
+	}
+
+	adminRequest(t, admin, http.MethodPost, "/nodes/root/api/disable", "")
+	proxied = httptest.NewRecorder()
+	g.ServeHTTP(proxied, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if proxied.Header().Get("X-Admin") != "" {
+		t.Error("Disabled node handled a request")
+	}
+
+	adminRequest(t, admin, http.MethodPost, "/nodes/root/api/enable", "")
+	rec = adminRequest(t, admin, http.MethodPost, "/nodes/root/api/modules", `{"kind": "test-header", "params": {"value": "never"}, "when": {"status": ["5xx"]}}`)
+	if rec.Code != http.StatusOK || len(api.Manglers()) != 2 {
+		t.Fatalf("Error adding conditional module: %s", rec.Body.String())
+	}
+	proxied = httptest.NewRecorder()
+	g.ServeHTTP(proxied, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if proxied.Header().Get("X-Admin") != "yes" {
+		t.Error("Conditional module was applied to a response not matching its conditions")
+	}
+	adminRequest(t, admin, http.MethodDelete, "/nodes/root/api/manglers/1", "")
+
+	rec = adminRequest(t, admin, http.MethodDelete, "/nodes/root/api/manglers/0", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Error removing mangler: %s", rec.Body.String())
+	}
+	proxied = httptest.NewRecorder()
+	g.ServeHTTP(proxied, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if proxied.Header().Get("X-Admin") != "" {
+		t.Error("Removed mangler was applied")
+	}
+	if len(api.RecentRequests()) != 3 {
+		t.Errorf("Expected 3 recent requests, got %d", len(api.RecentRequests()))
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	admin := NewAdmin(New())
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/nodes/nonexistent", "", http.StatusNotFound},
+		{http.MethodPost, "/nodes/root/matchers", `{"kind": "nonexistent"}`, http.StatusBadRequest},
+		{http.MethodPost, "/nodes/root/matchers", `{"kind": "host", "params": {"host": "("}}`, http.StatusBadRequest},
+		{http.MethodPost, "/nodes/root/modules", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/nodes/root/modules", `{"kind": "test-header", "when": {"status": ["ok"]}}`, http.StatusBadRequest},
+		{http.MethodDelete, "/nodes/root/matchers/0", "", http.StatusNotFound},
+		{http.MethodPost, "/tree", "", http.StatusMethodNotAllowed},
+	} {
+		if rec := adminRequest(t, admin, tc.method, tc.path, tc.body); rec.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.code, rec.Code)
+		}
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	admin := NewAdmin(New())
+	admin.Token = "s3cr3t"
+
+	for header, code := range map[string]int{"": http.StatusUnauthorized, "s3cr3t": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer s3cr3t": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/tree", nil)
+		r.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, r)
+		if rec.Code != code {
+			t.Errorf("Authorization %q: expected %d, got %d", header, code, rec.Code)
+		}
+	}
+
+	admin.Token = ""
+	admin.Authorize = func(r *http.Request) bool {
+		return r.RemoteAddr == "127.0.0.1:1234"
+	}
+	if rec := adminRequest(t, admin, http.MethodGet, "/tree", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Request rejected by Authorize was served: %d", rec.Code)
+	}
+}
+
+func TestAdminRefusesFileModules(t *testing.T) {
+	g := New()
+	admin := NewAdmin(g)
+
+	if rec := adminRequest(t, admin, http.MethodPost, "/nodes/root/modules", `{"kind": "test-file"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("File module was added: %d", rec.Code)
+	}
+
+	if len(g.manglers) != 0 {
+		t.Errorf("Manglers were added: %v", g.manglers)
+	}
+}
+
+func TestAdminConcurrentChanges(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	g := New()
+	child := g.Child()
+	admin := NewAdmin(g)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				adminRequest(t, admin, http.MethodPost, "/nodes/root/0/modules", `{"kind": "test-header"}`)
+				adminRequest(t, admin, http.MethodPost, "/nodes/root/0/disable", "")
+				adminRequest(t, admin, http.MethodDelete, "/nodes/root/0/manglers/0", "")
+				adminRequest(t, admin, http.MethodPost, "/nodes/root/0/enable", "")
+				adminRequest(t, admin, http.MethodGet, "/tree", "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !child.Enabled() {
+		t.Error("Child was left disabled")
+	}
+}
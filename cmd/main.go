@@ -1,42 +1,101 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"roob.re/goxxy"
-	"roob.re/goxxy/modules"
+	"roob.re/goxxy/config"
+	_ "roob.re/goxxy/modules" // Registers the modules so they can be used in the config
+	"syscall"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK          = 0
+	exitError       = 1 // Config could not be loaded, or the proxy could not be served
+	exitUndrained   = 2 // Connections were still open when the shutdown deadline was reached
+	exitFlushFailed = 3 // Some module could not write out its buffered output
 )
 
 func main() {
-	// Create a new proxy
-	proxy := goxxy.New()
-
-	// Add an EchoMangler, which just prints the request being mangled by this proxy
-	proxy.AddMangler(modules.EchoMangler("Parent", os.Stdout))
-
-	// Replace all links with https://www.roobre.es
-	rm := &modules.RegexMangler{}
-	rm.AddBodyRegex(`https?://(?:\w+\.\w+)+/`, "https://www.roobre.es/")
-	proxy.AddMangler(rm)
-
-	// Add a new child, with their own matchers and manglers.
-	// Requests are matched in depth, deepest match wins.
-	// A proxy without any Matchers matches anything, but will prioritize their children if they match
-	child1 := proxy.Child()
-	child1.Match(goxxy.HostMatcher(`(\w+\.)*google(\.\w{2,3})+`))
-	child1.AddMangler(modules.EchoMangler("google anything:", os.Stdout))
-
-	child11 := child1.Child()
-	// Multiple Matchers are OR'ed together, if any of them matches, the proxy will mangle this request.
-	child11.Match(goxxy.HostMatcher(`google.es`))
-	child11.Match(goxxy.HostMatcher(`google.co.uk`))
-	child11.AddMangler(modules.EchoMangler("google.es:", os.Stdout))
-
-	child2 := proxy.Child()
-	child2.Match(goxxy.HostMatcher(`(\w+\.)*facebook\.\w{2,3}`))
-	child2.AddMangler(modules.EchoMangler("facebook anything:", os.Stdout))
-
-	log.Println("Starting Goxxy on :8080")
-	http.ListenAndServe(":8080", proxy)
+	configPath := flag.String("config", "goxxy.yaml", "YAML or JSON file describing the proxy tree, see goxxy.example.yaml")
+	watch := flag.Duration("watch", 0, "If set, the config file is checked for changes with this interval and reloaded. It is always reloaded on SIGHUP.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for requests and tunnels to finish on SIGINT or SIGTERM before closing them.")
+	flag.Parse()
+
+	os.Exit(run(*configPath, *watch, *shutdownTimeout))
+}
+
+func run(configPath string, watch, shutdownTimeout time.Duration) int {
+	reloader, err := config.NewReloader(configPath)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+
+	reloader.ReloadOnSignal(syscall.SIGHUP)
+	if watch > 0 {
+		reloader.Watch(watch)
+	}
+
+	cfg := reloader.Config()
+
+	// The admin API allows to inspect and change the tree while it is running. Keep it away from clients.
+	// Changes made through it are lost when the config is reloaded.
+	if cfg.Admin != "" {
+		go func() {
+			log.Printf("Starting admin API on %s", cfg.Admin)
+			admin := goxxy.NewAdminFunc(reloader.Proxy)
+			admin.Token = cfg.AdminToken
+			log.Println(admin.ListenAndServe(cfg.Admin))
+		}()
+	}
+
+	if cfg.Metrics != "" {
+		go func() {
+			log.Printf("Serving metrics on %s", cfg.Metrics)
+			log.Println(cfg.Proxy.Metrics.ListenAndServe(cfg.Metrics))
+		}()
+	}
+
+	server := &goxxy.Server{}
+	server.Addr = cfg.Listen
+	server.Handler = reloader
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("Starting Goxxy on %s", cfg.Listen)
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		log.Printf("error serving proxy: %v", err)
+		return exitError
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	code := exitOK
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("connections still open after %s were closed: %v", shutdownTimeout, err)
+		code = exitUndrained
+	}
+
+	if err := reloader.Proxy().Flush(); err != nil {
+		log.Println(err)
+		code = exitFlushFailed
+	}
+
+	return code
 }
@@ -0,0 +1,346 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResponseMatcher is the response counterpart of Matcher. It decides whether a conditional mangler, built with When,
+// processes a response.
+type ResponseMatcher interface {
+	MatchResponse(*http.Response) bool
+}
+type ResponseMatcherFunc func(response *http.Response) bool
+
+func (rmf ResponseMatcherFunc) MatchResponse(response *http.Response) bool {
+	return rmf(response)
+}
+
+// When returns a Mangler which applies mangler only to the responses matched by condition, and passes the rest
+// through untouched. Errors from ErrManglers are still reported.
+func When(condition ResponseMatcher, mangler Mangler) Mangler {
+	return &conditionalMangler{condition: condition, mangler: mangler}
+}
+
+type conditionalMangler struct {
+	condition ResponseMatcher
+	mangler   Mangler
+}
+
+func (cm *conditionalMangler) Mangle(response *http.Response) *http.Response {
+	if !cm.condition.MatchResponse(response) {
+		return response
+	}
+
+	return cm.mangler.Mangle(response)
+}
+
+func (cm *conditionalMangler) MangleErr(response *http.Response) (*http.Response, error) {
+	if !cm.condition.MatchResponse(response) {
+		return response, nil
+	}
+
+	if errMangler, isErrMangler := cm.mangler.(ErrMangler); isErrMangler {
+		return errMangler.MangleErr(response)
+	}
+
+	return cm.mangler.Mangle(response), nil
+}
+
+// ModuleName reports the name of the wrapped mangler, so metrics are labeled the same whether it has conditions or not
+func (cm *conditionalMangler) ModuleName() string {
+	return ModuleName(cm.mangler)
+}
+
+func (cm *conditionalMangler) String() string {
+	return describe(cm.mangler) + " when " + describe(cm.condition)
+}
+
+// Unwrap returns the wrapped mangler
+func (cm *conditionalMangler) Unwrap() Mangler {
+	return cm.mangler
+}
+
+// AddModuleWhen works as AddModule, but the module only mangles the responses matched by condition, as with When.
+// Middlewares and FrameManglers are added unconditionally, and an error is returned if the module is not a Mangler.
+func (g *Goxxy) AddModuleWhen(condition ResponseMatcher, module interface{}) error {
+	mangler, isMangler := module.(Mangler)
+	if !isMangler {
+		return fmt.Errorf("%s is not a Mangler, so conditions cannot be applied to it", ModuleName(module))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if mw, isMiddleware := module.(Middleware); isMiddleware {
+		g.middlewares = append(g.middlewares, mw)
+	}
+	g.manglers = append(g.manglers, When(condition, mangler))
+	if fm, isFrameMangler := module.(FrameMangler); isFrameMangler {
+		g.frameManglers = append(g.frameManglers, fm)
+	}
+
+	return nil
+}
+
+// ResponseCondition describes a ResponseMatcher declaratively, e.g. in config files or the admin API.
+// A response matches if it satisfies every condition set, and unset conditions are ignored.
+type ResponseCondition struct {
+	Status      []string           `json:"status,omitempty" yaml:"status"`           // Status codes, as accepted by StatusMatcher
+	ContentType []string           `json:"contentType,omitempty" yaml:"contentType"` // Media types, as accepted by ResponseContentTypeMatcher
+	MinSize     *int64             `json:"minSize,omitempty" yaml:"minSize"`         // Minimum body size, in bytes
+	MaxSize     *int64             `json:"maxSize,omitempty" yaml:"maxSize"`         // Maximum body size, in bytes
+	Headers     map[string]string  `json:"headers,omitempty" yaml:"headers"`         // Header names and regexes their value must match. Empty regexes check the header is present.
+	Not         *ResponseCondition `json:"not,omitempty" yaml:"not"`                 // Conditions the response must not satisfy, e.g. {"contentType": ["image/*"]}
+}
+
+// Matcher builds the ResponseMatcher described by rc
+func (rc *ResponseCondition) Matcher() (ResponseMatcher, error) {
+	var matchers []ResponseMatcher
+
+	if len(rc.Status) > 0 {
+		m, err := StatusMatcher(rc.Status...)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	if len(rc.ContentType) > 0 {
+		m, err := ResponseContentTypeMatcher(rc.ContentType...)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	if rc.MinSize != nil || rc.MaxSize != nil {
+		min, max := int64(0), int64(-1)
+		if rc.MinSize != nil {
+			min = *rc.MinSize
+		}
+		if rc.MaxSize != nil {
+			max = *rc.MaxSize
+		}
+
+		m, err := ResponseBodySizeMatcher(min, max)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	names := make([]string, 0, len(rc.Headers))
+	for name := range rc.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m, err := ResponseHeaderMatcher(name, rc.Headers[name])
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	if rc.Not != nil {
+		m, err := rc.Not.Matcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, NotResponse(m))
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("no conditions set")
+	}
+
+	return allResponses(matchers), nil
+}
+
+// NotResponse returns a ResponseMatcher which matches responses not matched by matcher
+func NotResponse(matcher ResponseMatcher) ResponseMatcher {
+	return notResponse{matcher}
+}
+
+type notResponse struct {
+	matcher ResponseMatcher
+}
+
+func (nr notResponse) MatchResponse(response *http.Response) bool {
+	return !nr.matcher.MatchResponse(response)
+}
+
+func (nr notResponse) String() string {
+	return "not (" + describe(nr.matcher) + ")"
+}
+
+// allResponses matches responses matched by all of its matchers
+type allResponses []ResponseMatcher
+
+func (ar allResponses) MatchResponse(response *http.Response) bool {
+	for _, m := range ar {
+		if !m.MatchResponse(response) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ar allResponses) String() string {
+	descriptions := make([]string, 0, len(ar))
+	for _, m := range ar {
+		descriptions = append(descriptions, describe(m))
+	}
+
+	return strings.Join(descriptions, " and ")
+}
+
+// StatusMatcher returns a ResponseMatcher which matches responses whose status is any of the given ones.
+// Statuses can be single codes such as 200, classes such as 2xx, or ranges such as 200-299.
+func StatusMatcher(statuses ...string) (ResponseMatcher, error) {
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("at least one status is required")
+	}
+
+	sm := &statusMatcher{statuses: statuses}
+	for _, status := range statuses {
+		min, max, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		sm.ranges = append(sm.ranges, [2]int{min, max})
+	}
+
+	return sm, nil
+}
+
+func parseStatusRange(status string) (int, int, error) {
+	status = strings.TrimSpace(status)
+
+	if len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx") && status[0] >= '1' && status[0] <= '5' {
+		class := int(status[0]-'0') * 100
+		return class, class + 99, nil
+	}
+
+	bounds := strings.SplitN(status, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status %q", status)
+	}
+
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid status %q", status)
+		}
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid status range %q", status)
+	}
+
+	return min, max, nil
+}
+
+type statusMatcher struct {
+	ranges   [][2]int
+	statuses []string
+}
+
+func (sm *statusMatcher) MatchResponse(response *http.Response) bool {
+	for _, r := range sm.ranges {
+		if response.StatusCode >= r[0] && response.StatusCode <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (sm *statusMatcher) String() string {
+	return "status " + strings.Join(sm.statuses, ", ")
+}
+
+// ResponseContentTypeMatcher returns a ResponseMatcher which matches responses with any of the given media types.
+// Parameters, such as charset, are ignored, and wildcards such as image/* are allowed.
+func ResponseContentTypeMatcher(mediaTypes ...string) (ResponseMatcher, error) {
+	matcher, err := ContentTypeMatcher(mediaTypes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseContentTypeMatcher{matcher.(contentTypeMatcher)}, nil
+}
+
+type responseContentTypeMatcher struct {
+	mediaTypes contentTypeMatcher
+}
+
+func (rctm responseContentTypeMatcher) MatchResponse(response *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return err == nil && rctm.mediaTypes.matches(mediaType)
+}
+
+func (rctm responseContentTypeMatcher) String() string {
+	return rctm.mediaTypes.String()
+}
+
+// ResponseBodySizeMatcher returns a ResponseMatcher which matches responses whose body is between min and max bytes
+// long, both included. A negative max sets no upper limit. The size is taken from Content-Length, so responses whose
+// length is not known in advance, such as chunked ones, never match.
+func ResponseBodySizeMatcher(min, max int64) (ResponseMatcher, error) {
+	matcher, err := BodySizeMatcher(min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	return responseBodySizeMatcher{matcher.(*bodySizeMatcher)}, nil
+}
+
+type responseBodySizeMatcher struct {
+	size *bodySizeMatcher
+}
+
+func (rbsm responseBodySizeMatcher) MatchResponse(response *http.Response) bool {
+	size := response.ContentLength
+	if response.Body == nil || response.Body == http.NoBody {
+		size = 0
+	}
+
+	return rbsm.size.matches(size)
+}
+
+func (rbsm responseBodySizeMatcher) String() string {
+	return rbsm.size.String()
+}
+
+// ResponseHeaderMatcher returns a ResponseMatcher which matches responses with a header named name, any of whose
+// values matches valueRegex. An empty valueRegex matches any value, so only the presence of the header is checked.
+func ResponseHeaderMatcher(name, valueRegex string) (ResponseMatcher, error) {
+	regex, err := regexp.Compile(valueRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responseHeaderMatcher{name: http.CanonicalHeaderKey(name), regex: regex}, nil
+}
+
+type responseHeaderMatcher struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+func (rhm *responseHeaderMatcher) MatchResponse(response *http.Response) bool {
+	return anyMatches(rhm.regex, headerValues(response.Header, rhm.name))
+}
+
+func (rhm *responseHeaderMatcher) String() string {
+	return fmt.Sprintf("header %s ~ %q", rhm.name, rhm.regex)
+}
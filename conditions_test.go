@@ -0,0 +1,158 @@
+package goxxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func conditionResponse(status int, contentType string, length int64) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {contentType}, "X-Cache": {"MISS", "HIT from edge"}},
+		ContentLength: length,
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+	}
+}
+
+func TestResponseMatchers(t *testing.T) {
+	must := func(m ResponseMatcher, err error) ResponseMatcher {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	html := conditionResponse(http.StatusOK, "text/html; charset=utf-8", 1024)
+	png := conditionResponse(http.StatusNotFound, "image/png", -1)
+
+	for _, tc := range []struct {
+		matcher   ResponseMatcher
+		html, png bool
+	}{
+		{must(StatusMatcher("200")), true, false},
+		{must(StatusMatcher("2xx", "300-304")), true, false},
+		{must(StatusMatcher("4XX")), false, true},
+		{must(ResponseContentTypeMatcher("text/html")), true, false},
+		{must(ResponseContentTypeMatcher("image/*")), false, true},
+		{must(ResponseBodySizeMatcher(0, 1024)), true, false},
+		{must(ResponseBodySizeMatcher(1025, -1)), false, false},
+		{must(ResponseHeaderMatcher("x-cache", "^HIT")), true, true},
+		{must(ResponseHeaderMatcher("Set-Cookie", "")), false, false},
+		{NotResponse(must(ResponseContentTypeMatcher("image/*"))), true, false},
+	} {
+		if tc.matcher.MatchResponse(html) != tc.html || tc.matcher.MatchResponse(png) != tc.png {
+			t.Errorf("%s: expected %t for html and %t for png", describe(tc.matcher), tc.html, tc.png)
+		}
+	}
+
+	for name, err := range map[string]error{
+		"no statuses":  responseErr(StatusMatcher()),
+		"status":       responseErr(StatusMatcher("OK")),
+		"range":        responseErr(StatusMatcher("299-200")),
+		"class":        responseErr(StatusMatcher("9xx")),
+		"content type": responseErr(ResponseContentTypeMatcher("html")),
+		"size":         responseErr(ResponseBodySizeMatcher(2, 1)),
+		"header":       responseErr(ResponseHeaderMatcher("X-Cache", "(")),
+	} {
+		if err == nil {
+			t.Errorf("%s: no error returned", name)
+		}
+	}
+}
+
+func responseErr(_ ResponseMatcher, err error) error {
+	return err
+}
+
+func TestResponseCondition(t *testing.T) {
+	var condition ResponseCondition
+	if err := json.Unmarshal([]byte(`{"status": ["2xx"], "maxSize": 2048, "headers": {"X-Cache": "HIT"}, "not": {"contentType": ["image/*"]}}`), &condition); err != nil {
+		t.Fatal(err)
+	}
+
+	matcher, err := condition.Matcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !matcher.MatchResponse(conditionResponse(http.StatusOK, "text/html", 1024)) {
+		t.Error("Response satisfying all conditions did not match")
+	}
+	if matcher.MatchResponse(conditionResponse(http.StatusOK, "image/png", 1024)) {
+		t.Error("Negated condition was ignored")
+	}
+	if matcher.MatchResponse(conditionResponse(http.StatusOK, "text/html", 4096)) {
+		t.Error("Size condition was ignored")
+	}
+
+	const description = `status 2xx and body size in [0, 2048] and header X-Cache ~ "HIT" and not (content type image/*)`
+	if describe(matcher) != description {
+		t.Errorf("Unexpected description %s", describe(matcher))
+	}
+
+	if _, err := (&ResponseCondition{}).Matcher(); err == nil {
+		t.Error("Empty condition did not return an error")
+	}
+}
+
+type flushCounter struct {
+	flushes int
+}
+
+func (fc *flushCounter) Middleware(next http.Handler) http.Handler {
+	return next
+}
+
+func (fc *flushCounter) Mangle(response *http.Response) *http.Response {
+	response.Header.Set("X-Mangled", "yes")
+	return response
+}
+
+func (fc *flushCounter) Flush() error {
+	fc.flushes++
+	return nil
+}
+
+func TestWhen(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			rw.Header().Set("Content-Type", "image/png")
+		}
+		rw.Write([]byte("content"))
+	}))
+	defer upstream.Close()
+
+	condition, _ := ResponseContentTypeMatcher("image/*")
+	module := &flushCounter{}
+
+	g := New()
+	if err := g.AddModuleWhen(NotResponse(condition), module); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.Middlewares()) != 1 || ModuleName(g.Manglers()[0]) != "goxxy.flushCounter" {
+		t.Error("Module was not added as Middleware and conditional Mangler")
+	}
+
+	for path, mangled := range map[string]bool{"/image": false, "/text": true} {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL+path, nil))
+		if (rec.Header().Get("X-Mangled") == "yes") != mangled {
+			t.Errorf("%s: expected mangled to be %t", path, mangled)
+		}
+	}
+
+	g.Flush()
+	if module.flushes != 1 {
+		t.Errorf("Module flushed %d times", module.flushes)
+	}
+
+	if err := g.AddModuleWhen(condition, MiddlewareFunc(func(next http.Handler) http.Handler { return next })); err == nil {
+		t.Error("Conditions were accepted for a Middleware")
+	}
+}
@@ -0,0 +1,624 @@
+// Package config builds Goxxy trees from declarative YAML or JSON files.
+//
+// A config file describes the addresses Goxxy listens on and the tree of nodes, each of them with its settings,
+// matchers, modules and children:
+//
+//	listen: ":8080"
+//	admin: "127.0.0.1:8081"
+//	metrics: "127.0.0.1:9090"
+//	trace: [log]
+//	root:
+//	  modules:
+//	    - kind: echo
+//	      prefix: "Parent"
+//	  children:
+//	    - name: google
+//	      matchers:
+//	        - kind: host
+//	          host: '(\w+\.)*google(\.\w{2,3})+'
+//	      modules:
+//	        - kind: regex
+//	          body:
+//	            - search: 'https?://(?:\w+\.\w+)+/'
+//	              replace: "https://www.roobre.es/"
+//
+// Matchers and modules are built by the factories registered with goxxy.RegisterMatcher and goxxy.RegisterModule,
+// which receive every key of their entry besides kind as parameters. Modules can also have a when key, restricting the
+// responses they mangle as described by goxxy.ResponseCondition:
+//
+//	modules:
+//	  - kind: html
+//	    when: {status: [200], contentType: [text/html]}
+//	    modifiers: [{selector: script, action: remove}]
+//
+// Children inherit the settings of their parent, as with goxxy.Goxxy.Child.
+// Errors are reported along with the file, line and column they were found at.
+package config // import "roob.re/goxxy/config"
+
+import (
+	"crypto/x509"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"roob.re/goxxy"
+	"strings"
+	"time"
+)
+
+// Config is the result of loading a config file
+type Config struct {
+	Listen     string       // Address the proxy should listen on
+	Admin      string       // Address the admin API should listen on, if any
+	AdminToken string       // Token the admin API requires, see goxxy.Admin.Token
+	Metrics    string       // Address metrics should be served on, if any. If set, Proxy.Metrics is set as well.
+	Proxy      *goxxy.Goxxy // Tree built from the root node
+}
+
+// Error is a problem found in a config file
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+// Load reads and builds the config file at path. Files with the .json extension are parsed as JSON, and anything
+// else as YAML.
+func Load(path string) (*Config, error) {
+	return (&parser{file: path}).load()
+}
+
+// Parse builds a config from its contents. name is the name errors are reported with.
+func Parse(name string, data []byte) (*Config, error) {
+	return (&parser{file: name}).parse(data)
+}
+
+type parser struct {
+	file    string
+	metrics *goxxy.Metrics // If set, metrics are kept in it regardless of the Metrics address
+}
+
+func (p *parser) load() (*Config, error) {
+	data, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.parse(data)
+}
+
+func (p *parser) parse(data []byte) (*Config, error) {
+	name := p.file
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		// JSON is a subset of YAML, except for tabs, which YAML does not allow as indentation.
+		// JSON strings cannot contain raw tabs, so every tab is whitespace and can be safely replaced.
+		data = []byte(strings.Replace(string(data), "\t", " ", -1))
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	if len(document.Content) == 0 {
+		return nil, fmt.Errorf("%s: config is empty", name)
+	}
+
+	return p.config(document.Content[0])
+}
+
+// errorf returns an Error pointing to node
+func (p *parser) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return &Error{File: p.file, Line: node.Line, Column: node.Column, Err: fmt.Errorf(format, args...)}
+}
+
+// wrap returns err as an Error pointing to node. Errors found by yaml while decoding node point to the offending value
+// instead, if it can be found.
+func (p *parser) wrap(node *yaml.Node, err error) error {
+	if _, isConfigErr := err.(*Error); isConfigErr {
+		return err
+	}
+
+	if typeErr, isTypeErr := err.(*yaml.TypeError); isTypeErr && len(typeErr.Errors) > 0 {
+		var line int
+		var message string
+		if n, _ := fmt.Sscanf(typeErr.Errors[0], "line %d:", &line); n == 1 {
+			message = strings.TrimSpace(strings.SplitN(typeErr.Errors[0], ":", 2)[1])
+			if found := lastOnLine(node, line); found != nil {
+				return &Error{File: p.file, Line: found.Line, Column: found.Column, Err: fmt.Errorf("%s", message)}
+			}
+		}
+	}
+
+	return &Error{File: p.file, Line: node.Line, Column: node.Column, Err: err}
+}
+
+// lastOnLine returns the last node found in line within the tree rooted at node, which is the value in "key: value" lines
+func lastOnLine(node *yaml.Node, line int) *yaml.Node {
+	var found *yaml.Node
+	if node.Line == line {
+		found = node
+	}
+
+	for _, child := range node.Content {
+		if last := lastOnLine(child, line); last != nil {
+			found = last
+		}
+	}
+
+	return found
+}
+
+// decode decodes node into v, making sure it only contains the keys listed in v's yaml tags
+func (p *parser) decode(node *yaml.Node, v interface{}, keys ...string) error {
+	if node.Kind != yaml.MappingNode {
+		return p.errorf(node, "expected a mapping")
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !contains(keys, key.Value) {
+			return p.errorf(key, "unknown key %q", key.Value)
+		}
+	}
+
+	if err := node.Decode(v); err != nil {
+		return p.wrap(node, err)
+	}
+
+	return nil
+}
+
+func (p *parser) config(node *yaml.Node) (*Config, error) {
+	var top struct {
+		Listen     string    `yaml:"listen"`
+		Admin      string    `yaml:"admin"`
+		AdminToken string    `yaml:"adminToken"`
+		Metrics    string    `yaml:"metrics"`
+		Trace      []string  `yaml:"trace"`
+		Root       yaml.Node `yaml:"root"`
+	}
+	if err := p.decode(node, &top, "listen", "admin", "adminToken", "metrics", "trace", "root"); err != nil {
+		return nil, err
+	}
+
+	if top.Root.Kind == 0 {
+		return nil, p.errorf(node, "root node is missing")
+	}
+
+	config := &Config{Listen: top.Listen, Admin: top.Admin, AdminToken: top.AdminToken, Metrics: top.Metrics, Proxy: goxxy.New()}
+	if config.Listen == "" {
+		config.Listen = ":8080"
+	}
+	config.Proxy.Metrics = p.metrics
+	if config.Proxy.Metrics == nil && config.Metrics != "" {
+		config.Proxy.Metrics = goxxy.NewMetrics()
+	}
+
+	for _, name := range top.Trace {
+		output, exists := traceOutputs[strings.ToLower(name)]
+		if !exists {
+			return nil, p.errorf(valueOf(node, "trace"), "unknown trace output %q", name)
+		}
+		config.Proxy.Trace |= output
+	}
+
+	if err := p.node(&top.Root, config.Proxy); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// nodeConfig holds the settings of a node. Unset settings are inherited from the parent.
+type nodeConfig struct {
+	Name            string           `yaml:"name"`
+	Upstreams       []string         `yaml:"upstreams"`
+	PreserveHost    *bool            `yaml:"preserveHost"`
+	MangleRedirects bool             `yaml:"mangleRedirects"`
+	ViaName         *string          `yaml:"viaName"`
+	Forwarding      *[]string        `yaml:"forwarding"`
+	OnModuleError   string           `yaml:"onModuleError"`
+	Transport       *transportConfig `yaml:"transport"`
+	CA              *caConfig        `yaml:"ca"`
+	Matchers        []yaml.Node      `yaml:"matchers"`
+	Modules         []yaml.Node      `yaml:"modules"`
+	Children        []yaml.Node      `yaml:"children"`
+}
+
+var nodeKeys = []string{"name", "upstreams", "preserveHost", "mangleRedirects", "viaName", "forwarding",
+	"onModuleError", "transport", "ca", "matchers", "modules", "children"}
+
+type transportConfig struct {
+	Timeout               *time.Duration `yaml:"timeout"`
+	FollowRedirects       *bool          `yaml:"followRedirects"`
+	InsecureSkipVerify    *bool          `yaml:"insecureSkipVerify"`
+	RootCAs               string         `yaml:"rootCAs"`
+	MaxIdleConns          *int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost   *int           `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeout       *time.Duration `yaml:"idleConnTimeout"`
+	DialTimeout           *time.Duration `yaml:"dialTimeout"`
+	KeepAlive             *time.Duration `yaml:"keepAlive"`
+	TLSHandshakeTimeout   *time.Duration `yaml:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout *time.Duration `yaml:"responseHeaderTimeout"`
+	ParentProxy           *string        `yaml:"parentProxy"`
+}
+
+var transportKeys = []string{"timeout", "followRedirects", "insecureSkipVerify", "rootCAs", "maxIdleConns",
+	"maxIdleConnsPerHost", "idleConnTimeout", "dialTimeout", "keepAlive", "tlsHandshakeTimeout",
+	"responseHeaderTimeout", "parentProxy"}
+
+type caConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+var forwardingHeaders = map[string]goxxy.ForwardingHeaders{
+	"x-forwarded-for":   goxxy.HeaderXForwardedFor,
+	"x-forwarded-proto": goxxy.HeaderXForwardedProto,
+	"x-forwarded-host":  goxxy.HeaderXForwardedHost,
+	"forwarded":         goxxy.HeaderForwarded,
+	"via":               goxxy.HeaderVia,
+	"via-response":      goxxy.HeaderViaResponse,
+}
+
+var traceOutputs = map[string]goxxy.TraceOutput{
+	"header": goxxy.TraceHeader,
+	"log":    goxxy.TraceLog,
+}
+
+var errorPolicies = map[string]goxxy.ErrorPolicy{
+	"passthrough": goxxy.PassThrough,
+	"badgateway":  goxxy.BadGateway,
+	"abort":       goxxy.Abort,
+}
+
+// node applies the settings described by node to g, and builds its matchers, modules and children
+func (p *parser) node(node *yaml.Node, g *goxxy.Goxxy) error {
+	var nc nodeConfig
+	if err := p.decode(node, &nc, nodeKeys...); err != nil {
+		return err
+	}
+
+	g.Name = nc.Name
+	g.MangleRedirects = nc.MangleRedirects
+	if nc.PreserveHost != nil {
+		g.PreserveHost = *nc.PreserveHost
+	}
+	if nc.ViaName != nil {
+		g.ViaName = *nc.ViaName
+	}
+
+	if nc.Forwarding != nil {
+		g.Forwarding = 0
+		for _, name := range *nc.Forwarding {
+			flag, exists := forwardingHeaders[strings.ToLower(name)]
+			if !exists {
+				return p.errorf(valueOf(node, "forwarding"), "unknown forwarding header %q", name)
+			}
+			g.Forwarding |= flag
+		}
+	}
+
+	if nc.OnModuleError != "" {
+		policy, exists := errorPolicies[strings.ToLower(nc.OnModuleError)]
+		if !exists {
+			return p.errorf(valueOf(node, "onModuleError"), "unknown error policy %q", nc.OnModuleError)
+		}
+		g.OnModuleError = policy
+	}
+
+	if len(nc.Upstreams) > 0 {
+		if err := g.SetUpstreams(nc.Upstreams...); err != nil {
+			return p.wrap(valueOf(node, "upstreams"), err)
+		}
+	}
+
+	if nc.Transport != nil {
+		if err := p.transport(valueOf(node, "transport"), &g.Transport); err != nil {
+			return err
+		}
+	}
+
+	if nc.CA != nil {
+		ca, err := goxxy.LoadCertAuthority(nc.CA.Cert, nc.CA.Key)
+		if err != nil {
+			return p.wrap(valueOf(node, "ca"), err)
+		}
+		g.CA = ca
+	}
+
+	for i := range nc.Matchers {
+		matcher, err := p.matcher(&nc.Matchers[i])
+		if err != nil {
+			return err
+		}
+		g.Match(matcher)
+	}
+
+	for i := range nc.Modules {
+		module, err := p.module(&nc.Modules[i])
+		if err != nil {
+			return err
+		}
+
+		if when := valueOf(&nc.Modules[i], "when"); when != nil {
+			condition, err := p.condition(when)
+			if err != nil {
+				return err
+			}
+			if err := g.AddModuleWhen(condition, module); err != nil {
+				return p.wrap(&nc.Modules[i], err)
+			}
+			continue
+		}
+
+		if err := g.AddModule(module); err != nil {
+			return p.wrap(&nc.Modules[i], err)
+		}
+	}
+
+	// Children are created last, so they inherit the settings above
+	for i := range nc.Children {
+		if err := p.node(&nc.Children[i], g.Child()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transport applies the settings described by node over tc
+func (p *parser) transport(node *yaml.Node, tc *goxxy.TransportConfig) error {
+	var config transportConfig
+	if err := p.decode(node, &config, transportKeys...); err != nil {
+		return err
+	}
+
+	setDuration(&tc.Timeout, config.Timeout)
+	setDuration(&tc.IdleConnTimeout, config.IdleConnTimeout)
+	setDuration(&tc.DialTimeout, config.DialTimeout)
+	setDuration(&tc.KeepAlive, config.KeepAlive)
+	setDuration(&tc.TLSHandshakeTimeout, config.TLSHandshakeTimeout)
+	setDuration(&tc.ResponseHeaderTimeout, config.ResponseHeaderTimeout)
+
+	if config.FollowRedirects != nil {
+		tc.FollowRedirects = *config.FollowRedirects
+	}
+	if config.InsecureSkipVerify != nil {
+		tc.InsecureSkipVerify = *config.InsecureSkipVerify
+	}
+	if config.MaxIdleConns != nil {
+		tc.MaxIdleConns = *config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost != nil {
+		tc.MaxIdleConnsPerHost = *config.MaxIdleConnsPerHost
+	}
+
+	if config.RootCAs != "" {
+		pem, err := ioutil.ReadFile(config.RootCAs)
+		if err != nil {
+			return p.wrap(valueOf(node, "rootCAs"), err)
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return p.errorf(valueOf(node, "rootCAs"), "no certificates found in %s", config.RootCAs)
+		}
+	}
+
+	if config.ParentProxy != nil {
+		tc.ParentProxy = nil
+		if *config.ParentProxy != "" {
+			parent, err := goxxy.ParseParentProxy(*config.ParentProxy)
+			if err != nil {
+				return p.wrap(valueOf(node, "parentProxy"), err)
+			}
+			tc.ParentProxy = parent
+		}
+	}
+
+	return nil
+}
+
+// kind returns the kind of a matcher or module entry
+func (p *parser) kind(node *yaml.Node) (string, error) {
+	if node.Kind != yaml.MappingNode {
+		return "", p.errorf(node, "expected a mapping with a kind")
+	}
+
+	kind := valueOf(node, "kind")
+	if kind == nil || kind.Value == "" {
+		return "", p.errorf(node, "kind is missing")
+	}
+
+	return kind.Value, nil
+}
+
+func (p *parser) matcher(node *yaml.Node) (goxxy.Matcher, error) {
+	kind, err := p.kind(node)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher, err := goxxy.NewMatcher(kind, p.decoder(node))
+	if err != nil {
+		return nil, p.wrap(node, err)
+	}
+
+	return matcher, nil
+}
+
+func (p *parser) module(node *yaml.Node) (interface{}, error) {
+	kind, err := p.kind(node)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := goxxy.NewModule(kind, p.decoder(node))
+	if err != nil {
+		return nil, p.wrap(node, err)
+	}
+
+	return module, nil
+}
+
+var conditionKeys = []string{"status", "contentType", "minSize", "maxSize", "headers", "not"}
+
+// condition builds the goxxy.ResponseMatcher described by the when key of a module
+func (p *parser) condition(node *yaml.Node) (goxxy.ResponseMatcher, error) {
+	var condition goxxy.ResponseCondition
+	if err := p.decode(node, &condition, conditionKeys...); err != nil {
+		return nil, err
+	}
+
+	// Nested conditions are decoded along with their parent, but their keys must be checked too
+	if not := valueOf(node, "not"); not != nil {
+		if _, err := p.condition(not); err != nil {
+			return nil, err
+		}
+	}
+
+	matcher, err := condition.Matcher()
+	if err != nil {
+		return nil, p.wrap(node, err)
+	}
+
+	return matcher, nil
+}
+
+// decoder returns a goxxy.Decoder for the parameters of a matcher or module, which are all the keys besides kind and,
+// for modules, when
+func (p *parser) decoder(node *yaml.Node) goxxy.Decoder {
+	params := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+	for i := 0; i < len(node.Content); i += 2 {
+		if key := node.Content[i].Value; key != "kind" && key != "when" {
+			params.Content = append(params.Content, node.Content[i], node.Content[i+1])
+		}
+	}
+
+	return func(v interface{}) error {
+		if key := unknownKey(params, reflect.TypeOf(v)); key != nil {
+			return p.errorf(key, "unknown key %q", key.Value)
+		}
+
+		if err := params.Decode(v); err != nil {
+			return p.wrap(node, err)
+		}
+		return nil
+	}
+}
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// unknownKey returns the first key of node, or of the mappings nested in it, which has no field in t, the type node is
+// decoded into, so typos in the parameters of matchers and modules are reported. Maps accept any key, and types which
+// unmarshal themselves are not checked.
+func unknownKey(node *yaml.Node, t reflect.Type) *yaml.Node {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	if t == reflect.TypeOf(yaml.Node{}) || reflect.PtrTo(t).Implements(yamlUnmarshaler) {
+		return nil
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field, exists := fields[node.Content[i].Value]
+			if !exists {
+				return node.Content[i]
+			}
+			if key := unknownKey(node.Content[i+1], field); key != nil {
+				return key
+			}
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if key := unknownKey(node.Content[i], t.Elem()); key != nil {
+				return key
+			}
+		}
+
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			if key := unknownKey(item, t.Elem()); key != nil {
+				return key
+			}
+		}
+	}
+
+	return nil
+}
+
+// yamlFields returns the types of the fields of struct t by the key yaml.v3 decodes them from, including the fields of
+// inlined structs
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		if contains(tag[1:], "inline") {
+			for name, inlined := range yamlFields(field.Type) {
+				fields[name] = inlined
+			}
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+
+	return fields
+}
+
+// valueOf returns the value of key in a mapping node, or nil if it is not present
+func valueOf(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+func setDuration(dst *time.Duration, src *time.Duration) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy"
+	_ "roob.re/goxxy/modules"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../cmd/goxxy.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":8080" || cfg.Admin != "127.0.0.1:8081" || cfg.AdminToken != "change-me" {
+		t.Errorf("Unexpected addresses %q and %q, or admin token %q", cfg.Listen, cfg.Admin, cfg.AdminToken)
+	}
+
+	children := cfg.Proxy.Children()
+	if len(children) != 2 || children[0].Name != "google" || len(children[0].Children()) != 1 {
+		t.Fatal("Tree was not built as described")
+	}
+
+	if len(cfg.Proxy.Manglers()) != 2 || len(cfg.Proxy.Middlewares()) != 1 || len(children[0].Children()[0].Matchers()) != 2 {
+		t.Error("Modules or matchers were not added")
+	}
+}
+
+func TestParse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Server", "nginx")
+		rw.Write([]byte("<html><body><script>evil()</script><p>Hello</p></body></html>"))
+	}))
+	defer upstream.Close()
+
+	// Tabs are used on purpose, as they are not valid YAML indentation
+	cfg, err := Parse("goxxy.json", []byte(`{
+	"metrics": "127.0.0.1:9090",
+	"trace": ["header"],
+	"root": {
+		"transport": {"timeout": "3s", "followRedirects": true},
+		"forwarding": ["x-forwarded-for"],
+		"children": [{
+			"name": "local",
+			"matchers": [{"kind": "host", "host": "127\\.0\\.0\\.1"}],
+			"modules": [
+				{"kind": "headers", "-Server": ""},
+				{"kind": "html", "modifiers": [{"selector": "script", "action": "remove"}]}
+			]
+		}]
+	}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Proxy.Metrics == nil || cfg.Listen != ":8080" || cfg.Proxy.Trace != goxxy.TraceHeader {
+		t.Error("Top-level settings were not applied")
+	}
+
+	child := cfg.Proxy.Children()[0]
+	if child.Transport.Timeout != 3*time.Second || !child.Transport.FollowRedirects || child.Forwarding != goxxy.HeaderXForwardedFor {
+		t.Error("Settings were not inherited by the child")
+	}
+
+	if child.Transport.DialTimeout != goxxy.DefaultTransportConfig.DialTimeout {
+		t.Error("Unset transport settings were overwritten")
+	}
+
+	rec := httptest.NewRecorder()
+	cfg.Proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	if strings.Contains(string(body), "script") || rec.Header().Get("Server") != "" {
+		t.Errorf("Modules were not applied: %s", body)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, config, err string
+	}{
+		{"missing root", "listen: :8080\n", "test.yaml:1:1: root node is missing"},
+		{"unknown key", "root:\n  matcher: []\n", `test.yaml:2:3: unknown key "matcher"`},
+		{"unknown matcher", "root:\n  matchers:\n    - kind: nope\n", `test.yaml:3:7: unknown matcher kind "nope"`},
+		{"missing kind", "root:\n  modules:\n    - prefix: foo\n", "test.yaml:3:7: kind is missing"},
+		{"invalid regex", "root:\n  children:\n    - matchers:\n        - kind: host\n          host: '('\n", "test.yaml:4:11: error parsing regexp"},
+		{"invalid module params", "root:\n  modules:\n    - kind: regex\n      body:\n        - search: '('\n", "test.yaml:3:7: invalid body regex"},
+		{"unknown module param", "root:\n  modules:\n    - kind: regex\n      body:\n        - serch: foo\n", `test.yaml:5:11: unknown key "serch"`},
+		{"unknown matcher param", "root:\n  matchers:\n    - kind: host\n      hots: example.com\n", `test.yaml:4:7: unknown key "hots"`},
+		{"invalid selector", "root:\n  modules:\n    - kind: html\n      modifiers: [{selector: '[', action: remove}]\n", "test.yaml:3:7: invalid selector"},
+		{"invalid duration", "root:\n  transport:\n    timeout: soon\n", "test.yaml:3:14: cannot unmarshal !!str `soon` into time.Duration"},
+		{"unknown policy", "root:\n  onModuleError: panic\n", `test.yaml:2:18: unknown error policy "panic"`},
+		{"invalid expression", "root:\n  matchers:\n    - kind: expr\n      expr: 'host ~'\n", "test.yaml:3:7: unexpected end of expression"},
+		{"unknown trace output", "trace: [stderr]\nroot: {}\n", `test.yaml:1:8: unknown trace output "stderr"`},
+		{"invalid upstream", "root:\n  upstreams: ['ftp://example.com']\n", "test.yaml:2:14: "},
+		{"invalid yaml", "root: [\n", "test.yaml: yaml: "},
+	} {
+		_, err := Parse("test.yaml", []byte(tc.config))
+		if err == nil {
+			t.Errorf("%s: no error returned", tc.name)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%s: unexpected error %q", tc.name, err)
+		}
+	}
+}
+
+func TestParseConditions(t *testing.T) {
+	cfg, err := Parse("test.yaml", []byte(`
+root:
+  modules:
+    - kind: headers
+      when: {status: [2xx], not: {contentType: [image/*]}}
+      X-Mangled: "yes"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manglers := cfg.Proxy.Manglers()
+	if len(manglers) != 1 || !strings.HasSuffix(manglers[0].(fmt.Stringer).String(), "when status 2xx and not (content type image/*)") {
+		t.Errorf("Conditions were not applied: %v", manglers)
+	}
+
+	for _, tc := range []struct {
+		name, config, err string
+	}{
+		{"unknown key", "root:\n  modules:\n    - kind: echo\n      when: {status: [200], type: html}\n", `test.yaml:4:29: unknown key "type"`},
+		{"unknown nested key", "root:\n  modules:\n    - kind: echo\n      when: {not: {type: html}}\n", `test.yaml:4:20: unknown key "type"`},
+		{"invalid status", "root:\n  modules:\n    - kind: echo\n      when: {status: [ok]}\n", `test.yaml:4:13: invalid status "ok"`},
+	} {
+		_, err := Parse("test.yaml", []byte(tc.config))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package config // import "roob.re/goxxy/config"
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"roob.re/goxxy"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves requests with the tree built from a config file, which can be reloaded while serving.
+// Requests already being served when the config is reloaded finish on the old tree, while new ones are handled by
+// the new one. Connections intercepted with CONNECT keep using the tree they were accepted with.
+// Invalid configs are rejected, and the running tree is kept. Modules of the replaced tree are flushed, see Goxxy.Flush.
+// Modules are built again, so state they keep in memory, such as the buckets of rate limiters, starts afresh.
+// Listen, Admin and Metrics addresses, along with the admin token, are read only once, when the Reloader is created. Metrics are preserved
+// across reloads.
+type Reloader struct {
+	path    string
+	current atomic.Value // *Config
+
+	mu      sync.Mutex // Serializes reloads
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the config file at path, and returns a Reloader serving it
+func NewReloader(path string) (*Reloader, error) {
+	r := &Reloader{path: path}
+	r.stat()
+
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.current.Store(cfg)
+	return r, nil
+}
+
+// Config returns the config currently being served
+func (r *Reloader) Config() *Config {
+	return r.current.Load().(*Config)
+}
+
+// Proxy returns the tree currently being served
+func (r *Reloader) Proxy() *goxxy.Goxxy {
+	return r.Config().Proxy
+}
+
+func (r *Reloader) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.Proxy().ServeHTTP(rw, req)
+}
+
+// Reload loads the config file again and starts serving it. If the new config is invalid, an error is returned and
+// the current one is kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stat()
+
+	old := r.Config()
+	p := &parser{file: r.path, metrics: old.Proxy.Metrics}
+	cfg, err := p.load()
+	if err != nil {
+		return err
+	}
+
+	// Addresses cannot be changed without restarting, so the running ones are kept
+	cfg.Listen, cfg.Admin, cfg.AdminToken, cfg.Metrics = old.Listen, old.Admin, old.AdminToken, old.Metrics
+
+	r.current.Store(cfg)
+
+	// Output of modules writing to files is shared by path with the new tree, but anything the old one buffered is
+	// written out now, as nothing else will
+	if err := old.Proxy.Flush(); err != nil {
+		log.Printf("error flushing modules of the previous config: %v", err)
+	}
+
+	return nil
+}
+
+// ReloadOnSignal reloads the config whenever one of the given signals, typically SIGHUP, is received.
+// Errors are logged. It returns a function which stops listening for the signals.
+func (r *Reloader) ReloadOnSignal(signals ...os.Signal) (stop func()) {
+	received := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(received, signals...)
+
+	go func() {
+		for {
+			select {
+			case <-received:
+				r.logReload()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(received)
+			close(done)
+		})
+	}
+}
+
+// Watch checks the config file for changes every interval, and reloads it when it is modified.
+// Errors are logged. It returns a function which stops watching.
+func (r *Reloader) Watch(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if r.changed() {
+					r.logReload()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+func (r *Reloader) logReload() {
+	if err := r.Reload(); err != nil {
+		log.Printf("error reloading config, keeping the current one: %v", err)
+		return
+	}
+
+	log.Printf("config reloaded from %s", r.path)
+}
+
+// stat records the modification time and size of the config file. r.mu must be held, or r not be in use yet.
+func (r *Reloader) stat() {
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime, r.size = info.ModTime(), info.Size()
+	}
+}
+
+// changed returns true if the config file has been modified since it was last loaded
+func (r *Reloader) changed() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, path, value string) {
+	t.Helper()
+
+	config := "metrics: 127.0.0.1:9090\nroot:\n  modules:\n    - kind: headers\n      X-Config: " + value + "\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func configValue(reloader http.Handler, url string) string {
+	rec := httptest.NewRecorder()
+	reloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	return rec.Header().Get("X-Config")
+}
+
+func TestReload(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "goxxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goxxy.yaml")
+
+	writeConfig(t, path, "first")
+	reloader, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := reloader.Proxy().Metrics
+
+	inFlight := make(chan string)
+	go func() {
+		inFlight <- configValue(reloader, upstream.URL+"/slow")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	writeConfig(t, path, "second")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := configValue(reloader, upstream.URL); value != "second" {
+		t.Errorf("New requests were served with config %q", value)
+	}
+
+	close(release)
+	if value := <-inFlight; value != "first" {
+		t.Errorf("Request in flight was served with config %q", value)
+	}
+
+	if reloader.Proxy().Metrics != metrics {
+		t.Error("Metrics were not preserved")
+	}
+
+	ioutil.WriteFile(path, []byte("root:\n  modules:\n    - kind: nope\n"), 0644)
+	if err := reloader.Reload(); err == nil {
+		t.Error("Invalid config was accepted")
+	}
+
+	if value := configValue(reloader, upstream.URL); value != "second" {
+		t.Errorf("Running config was not kept after a failed reload, got %q", value)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "goxxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goxxy.yaml")
+
+	writeConfig(t, path, "first")
+	reloader, err := NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := reloader.Watch(10 * time.Millisecond)
+	defer stop()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			configValue(reloader, upstream.URL)
+		}
+	}()
+
+	writeConfig(t, path, "watched")
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if configValue(reloader, upstream.URL) == "watched" {
+			wg.Wait()
+			return
+		}
+	}
+
+	t.Error("Config change was not picked up by the watcher")
+	wg.Wait()
+}
@@ -0,0 +1,251 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey struct{}
+
+// RequestContext holds the state of a single exchange as it travels through Goxxy.
+// It is attached to the context of the request received by middlewares, and to the one set in the response received by
+// manglers, so modules can use it to pass data from the request phase to the response phase.
+type RequestContext struct {
+	Request       *http.Request // Request as received from the client, before any middleware was applied. Its Body is shared with the request being proxied and must not be read.
+	Path          []*Goxxy      // Matched nodes, from the root to the one handling the request. Empty if nothing matched.
+	Start         time.Time     // Time the request was received
+	UpstreamStart time.Time     // Time the request was sent upstream
+	UpstreamEnd   time.Time     // Time the response headers were received from upstream
+	Status        int           // Status code sent to the client, or 0 if none was sent (e.g. the connection was aborted)
+	BytesIn       int64         // Bytes of the request body read from the client. Updated atomically, as the body may be read by another goroutine.
+	BytesOut      int64         // Bytes of the response body sent to the client
+	TrackChanges  bool          // If set before the response is mangled, manglers which change it are recorded in Changed
+	Changed       []string      // Names of the manglers which changed the response, as returned by ModuleName
+
+	labels []string
+
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// FromRequest returns the RequestContext attached to a request, or nil if there is none.
+func FromRequest(r *http.Request) *RequestContext {
+	if r == nil {
+		return nil
+	}
+
+	rc, _ := r.Context().Value(contextKey{}).(*RequestContext)
+	return rc
+}
+
+// FromResponse returns the RequestContext attached to the request of a response, or nil if there is none.
+func FromResponse(response *http.Response) *RequestContext {
+	if response == nil {
+		return nil
+	}
+
+	return FromRequest(response.Request)
+}
+
+// Node returns the Goxxy handling the request, or nil if nothing matched.
+func (rc *RequestContext) Node() *Goxxy {
+	if len(rc.Path) == 0 {
+		return nil
+	}
+
+	return rc.Path[len(rc.Path)-1]
+}
+
+// NodePath returns a human-readable representation of Path, such as "root/google/0".
+// Nodes are identified by their Name, or by their index among their siblings if they have none.
+func (rc *RequestContext) NodePath() string {
+	return strings.Join(rc.labels, "/")
+}
+
+// UpstreamLatency returns the time it took for upstream to answer with the response headers.
+func (rc *RequestContext) UpstreamLatency() time.Duration {
+	if rc.UpstreamEnd.IsZero() {
+		return 0
+	}
+
+	return rc.UpstreamEnd.Sub(rc.UpstreamStart)
+}
+
+// Set stores a value for the duration of the exchange. Keys should be of unexported types to avoid collisions, as in context.WithValue.
+func (rc *RequestContext) Set(key, value interface{}) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.values == nil {
+		rc.values = make(map[interface{}]interface{})
+	}
+	rc.values[key] = value
+}
+
+// Get returns a value previously stored with Set, or nil.
+func (rc *RequestContext) Get(key interface{}) interface{} {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.values[key]
+}
+
+// withRequestContext returns a shallow copy of r carrying rc. rc.Request is set to a snapshot of r, with its own
+// headers and URL, so it is not affected by middlewares changing them in place.
+func withRequestContext(r *http.Request, rc *RequestContext) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), contextKey{}, rc))
+
+	original := *r
+	original.Header = cloneHeader(r.Header)
+	if r.URL != nil {
+		u := *r.URL
+		original.URL = &u
+	}
+	rc.Request = &original
+
+	return r
+}
+
+// meteredWriter records the status and size of the response sent to the client in a RequestContext
+type meteredWriter struct {
+	http.ResponseWriter
+	rc *RequestContext
+}
+
+func (mw *meteredWriter) WriteHeader(status int) {
+	// Informational responses can precede the final one
+	if mw.rc.Status == 0 && status >= 200 {
+		mw.rc.Status = status
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	if mw.rc.Status == 0 {
+		mw.rc.Status = http.StatusOK
+	}
+	n, err := mw.ResponseWriter.Write(p)
+	mw.rc.BytesOut += int64(n)
+	return n, err
+}
+
+func (mw *meteredWriter) Flush() {
+	if flusher, isFlusher := mw.ResponseWriter.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// hijackableMeteredWriter is a meteredWriter for ResponseWriters which implement http.Hijacker.
+// Nothing is recorded once the connection is hijacked.
+type hijackableMeteredWriter struct {
+	*meteredWriter
+}
+
+func (hmw hijackableMeteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hmw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// meter wraps rw and r, so the size of the exchange and the status sent to the client are recorded in rc
+func meter(rw http.ResponseWriter, r *http.Request, rc *RequestContext) http.ResponseWriter {
+	if r.Body != nil {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &rc.BytesIn}
+	}
+
+	mw := &meteredWriter{ResponseWriter: rw, rc: rc}
+	if _, isHijacker := rw.(http.Hijacker); isHijacker {
+		return hijackableMeteredWriter{mw}
+	}
+
+	return mw
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// responseSnapshot is the state of a response before a mangler is applied, used to tell whether the mangler changed it.
+// Bodies are not read, so manglers which wrap the body are considered to change it even if the content stays the same.
+type responseSnapshot struct {
+	rc       *RequestContext
+	response *http.Response
+	status   int
+	header   http.Header
+	body     io.ReadCloser
+}
+
+// snapshotResponse returns a snapshot of response if rc tracks changes, or nil otherwise
+func snapshotResponse(rc *RequestContext, response *http.Response) *responseSnapshot {
+	if rc == nil || !rc.TrackChanges {
+		return nil
+	}
+
+	return &responseSnapshot{
+		rc:       rc,
+		response: response,
+		status:   response.StatusCode,
+		header:   cloneHeader(response.Header),
+		body:     response.Body,
+	}
+}
+
+// record adds the mangler to rc.Changed if mangled differs from the snapshot
+func (rs *responseSnapshot) record(mangled *http.Response, mangler Mangler) {
+	if rs == nil {
+		return
+	}
+
+	if mangled == rs.response && mangled.StatusCode == rs.status && sameBody(mangled.Body, rs.body) && sameHeader(mangled.Header, rs.header) {
+		return
+	}
+
+	rs.rc.Changed = append(rs.rc.Changed, ModuleName(mangler))
+}
+
+func sameBody(a, b io.ReadCloser) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	// Comparing interfaces holding values which cannot be compared panics
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+func sameHeader(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, values := range a {
+		other, exists := b[name]
+		if !exists || len(values) != len(other) {
+			return false
+		}
+		for i := range values {
+			if values[i] != other[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
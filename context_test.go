@@ -0,0 +1,66 @@
+package goxxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	g := New()
+	child := g.Child()
+	child.Name = "upstream"
+	child.MatchFunc(func(r *http.Request) bool { return true })
+	grandchild := child.Child()
+	grandchild.MatchFunc(func(r *http.Request) bool { return true })
+
+	var fromMangler *RequestContext
+	grandchild.AddMiddlewareFunc(func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			FromRequest(r).Set(testKey{}, "from middleware")
+			r.Header.Set("X-Middleware", "changed")
+			handler.ServeHTTP(rw, r)
+		})
+	})
+	grandchild.AddManglerFunc(func(response *http.Response) *http.Response {
+		fromMangler = FromResponse(response)
+		return response
+	})
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	g.ServeHTTP(httptest.NewRecorder(), req)
+
+	if fromMangler == nil {
+		t.Fatal("RequestContext not available from the response")
+	}
+
+	if fromMangler.Get(testKey{}) != "from middleware" {
+		t.Error("Value set by the middleware not available to the mangler")
+	}
+
+	if fromMangler.Request.RemoteAddr != "10.0.0.1:1234" {
+		t.Error("Original request not available from the context")
+	}
+
+	if fromMangler.Request.Header.Get("X-Middleware") != "" {
+		t.Error("Original request was changed by a middleware")
+	}
+
+	if fromMangler.Node() != grandchild || fromMangler.NodePath() != "root/upstream/0" {
+		t.Errorf("Unexpected node path %s", fromMangler.NodePath())
+	}
+
+	if fromMangler.Start.IsZero() || fromMangler.UpstreamLatency() <= 0 {
+		t.Error("Timings were not recorded")
+	}
+
+	if FromRequest(httptest.NewRequest(http.MethodGet, "/", nil)) != nil {
+		t.Error("RequestContext returned for a request which has none")
+	}
+}
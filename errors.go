@@ -0,0 +1,182 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ErrMangler is a Mangler which can fail. When a mangler added to a Goxxy implements ErrMangler, MangleErr is called
+// instead of Mangle, and errors are handled according to the ErrorPolicy of the node.
+// If an ErrMangler fails, Goxxy restores the status, headers and body the response had before calling it, including
+// anything read from the body, so changes it made in place are undone.
+type ErrMangler interface {
+	MangleErr(response *http.Response) (*http.Response, error)
+}
+type ErrManglerFunc func(response *http.Response) (*http.Response, error)
+
+func (emf ErrManglerFunc) MangleErr(response *http.Response) (*http.Response, error) {
+	return emf(response)
+}
+
+// Mangle implements Mangler, so ErrManglerFuncs can be added with AddMangler. Errors are ignored.
+func (emf ErrManglerFunc) Mangle(response *http.Response) *http.Response {
+	if mangled, err := emf(response); err == nil {
+		return mangled
+	}
+	return response
+}
+
+// recordedBody records what is read from a response body while an ErrMangler runs, so the body can be restored if the
+// mangler fails
+type recordedBody struct {
+	io.ReadCloser
+	mu        sync.Mutex
+	recording bool
+	read      bytes.Buffer
+}
+
+// recordBody starts recording the body of response, which is replaced by the returned recordedBody
+func recordBody(response *http.Response) *recordedBody {
+	if response.Body == nil {
+		return nil
+	}
+
+	body := &recordedBody{ReadCloser: response.Body, recording: true}
+	response.Body = body
+	return body
+}
+
+func (rb *recordedBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+
+	rb.mu.Lock()
+	if rb.recording {
+		rb.read.Write(p[:n])
+	}
+	rb.mu.Unlock()
+
+	return n, err
+}
+
+// stop stops recording once the mangler succeeded, unwrapping the body of mangled if it was left as it was
+func (rb *recordedBody) stop(mangled *http.Response) {
+	if rb == nil {
+		return
+	}
+
+	rb.mu.Lock()
+	rb.recording = false
+	rb.read = bytes.Buffer{}
+	rb.mu.Unlock()
+
+	if mangled != nil && mangled.Body == rb {
+		mangled.Body = rb.ReadCloser
+	}
+}
+
+// restore sets the body of response back to the original one, putting back what the failing mangler read from it
+func (rb *recordedBody) restore(response *http.Response) {
+	if rb == nil {
+		response.Body = nil
+		return
+	}
+
+	rb.mu.Lock()
+	rb.recording = false
+	read := rb.read.Bytes()
+	rb.mu.Unlock()
+
+	if len(read) == 0 {
+		response.Body = rb.ReadCloser
+		return
+	}
+
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(read), rb.ReadCloser), rb.ReadCloser}
+}
+
+// ErrMiddleware is the failing counterpart of Middleware. It receives the request before it is sent upstream and can
+// modify it in place. When a middleware added to a Goxxy implements ErrMiddleware, MiddlewareErr is called instead
+// of Middleware, and errors are handled according to the ErrorPolicy of the node.
+type ErrMiddleware interface {
+	MiddlewareErr(r *http.Request) error
+}
+type ErrMiddlewareFunc func(r *http.Request) error
+
+func (emf ErrMiddlewareFunc) MiddlewareErr(r *http.Request) error {
+	return emf(r)
+}
+
+// Middleware implements Middleware, so ErrMiddlewareFuncs can be added with AddMiddleware. Errors are ignored.
+func (emf ErrMiddlewareFunc) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		emf(r)
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// ErrorPolicy tells Goxxy what to do when a module fails
+type ErrorPolicy uint8
+
+const (
+	// PassThrough ignores the failing module: the request is sent upstream as if a failing middleware was not there,
+	// and the response a failing mangler received is passed to the next one.
+	PassThrough ErrorPolicy = iota
+	// BadGateway answers the client with 502 Bad Gateway
+	BadGateway
+	// Abort closes the client connection without answering
+	Abort
+)
+
+// ModuleError is reported to Goxxy.ErrorHook when a module fails
+type ModuleError struct {
+	Module  interface{}   // ErrMangler or ErrMiddleware which failed
+	Node    *Goxxy        // Goxxy the module belongs to
+	Request *http.Request // Request being handled
+	Err     error         // Error returned by the module
+}
+
+func (me *ModuleError) Error() string {
+	return fmt.Sprintf("module %T failed: %v", me.Module, me.Err)
+}
+
+// report passes a module error to the ErrorHook of the node, or logs it if there is none
+func (g *Goxxy) report(me *ModuleError) {
+	if g.ErrorHook != nil {
+		g.ErrorHook(me)
+		return
+	}
+
+	log.Printf("%s, policy %d applied", me.Error(), g.OnModuleError)
+}
+
+// moduleFailed answers the client according to g.OnModuleError, which must not be PassThrough
+func (g *Goxxy) moduleFailed(rw http.ResponseWriter) {
+	if g.OnModuleError == Abort && abortConnection(rw) {
+		return
+	}
+
+	http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
+
+// abortConnection forcefully closes the client connection, if the ResponseWriter allows it
+func abortConnection(rw http.ResponseWriter) bool {
+	hijacker, isHijacker := rw.(http.Hijacker)
+	if !isHijacker {
+		return false
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
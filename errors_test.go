@@ -0,0 +1,123 @@
+package goxxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy/tests"
+	"strings"
+	"testing"
+)
+
+func TestErrManglerPolicies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(tests.HTMLHandler))
+	defer upstream.Close()
+
+	var reported []*ModuleError
+	failing := ErrManglerFunc(func(response *http.Response) (*http.Response, error) {
+		response.Header.Set("X-Failing", "1")
+		return nil, errors.New("mangler failed")
+	})
+
+	g := New()
+	g.ErrorHook = func(me *ModuleError) {
+		reported = append(reported, me)
+	}
+	g.AddMangler(failing)
+	g.AddManglerFunc(func(response *http.Response) *http.Response {
+		response.Header.Set("X-After", "1")
+		return response
+	})
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-After") != "1" {
+		t.Errorf("PassThrough did not continue with the next mangler: %d %v", rec.Code, rec.Header())
+	}
+
+	if rec.Header().Get("X-Failing") != "" {
+		t.Errorf("Changes made by the failing mangler were not undone: %v", rec.Header())
+	}
+
+	if len(reported) != 1 || reported[0].Node != g || reported[0].Err.Error() != "mangler failed" {
+		t.Errorf("Error was not reported to the hook: %v", reported)
+	}
+
+	g.OnModuleError = BadGateway
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("X-After") != "" {
+		t.Errorf("BadGateway policy not applied: %d %v", rec.Code, rec.Header())
+	}
+
+	// Mangle always behaves as PassThrough
+	if response := g.Mangle(tests.GetResponse()); response == nil || response.Header.Get("X-After") != "1" {
+		t.Error("Mangle did not continue with the next mangler")
+	}
+}
+
+func TestErrManglerRestoresResponse(t *testing.T) {
+	g := New()
+	g.ErrorHook = func(me *ModuleError) {}
+	g.AddManglerFunc(func(response *http.Response) *http.Response {
+		response.Header.Set("X-First", "1")
+		response.Body = ioutil.NopCloser(strings.NewReader("mangled body"))
+		return response
+	})
+	g.AddMangler(ErrManglerFunc(func(response *http.Response) (*http.Response, error) {
+		buf := make([]byte, 7)
+		io.ReadFull(response.Body, buf)
+		response.Header.Set("X-Failing", "1")
+		response.StatusCode = http.StatusTeapot
+		response.Body = ioutil.NopCloser(strings.NewReader("replaced"))
+		return nil, errors.New("mangler failed")
+	}))
+	g.AddManglerFunc(func(response *http.Response) *http.Response {
+		response.Header.Set("X-After", "1")
+		return response
+	})
+
+	for _, policy := range []ErrorPolicy{PassThrough, BadGateway} {
+		g.OnModuleError = policy
+		response := g.Mangle(tests.GetResponse())
+		if response == nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("Status was not restored with policy %d: %v", policy, response)
+		}
+
+		if response.Header.Get("X-First") != "1" || response.Header.Get("X-Failing") != "" || response.Header.Get("X-After") != "1" {
+			t.Errorf("Unexpected headers with policy %d: %v", policy, response.Header)
+		}
+
+		if body, _ := ioutil.ReadAll(response.Body); string(body) != "mangled body" {
+			t.Errorf("Body was not restored with policy %d: %s", policy, body)
+		}
+	}
+}
+
+func TestErrMiddlewarePolicies(t *testing.T) {
+	var reached bool
+	g := New()
+	g.AddMiddleware(ErrMiddlewareFunc(func(r *http.Request) error {
+		return errors.New("middleware failed")
+	}))
+	g.ErrorHook = func(me *ModuleError) {}
+
+	handler := g.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), tests.Get())
+	if !reached {
+		t.Error("PassThrough did not call the next handler")
+	}
+
+	reached = false
+	g.OnModuleError = Abort
+	rec := httptest.NewRecorder() // Not a Hijacker, so 502 is expected
+	handler.ServeHTTP(rec, tests.Get())
+	if reached || rec.Code != http.StatusBadGateway {
+		t.Errorf("Abort policy not applied: %d", rec.Code)
+	}
+}
@@ -0,0 +1,397 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// exprField extracts the values an expression field refers to from a request. Fields taking an argument, such as
+// header("X-Debug"), receive it in arg.
+type exprField struct {
+	arg    bool
+	values func(r *http.Request, arg string) []string
+}
+
+// exprFields are the fields which can be used in matcher expressions
+var exprFields = map[string]exprField{
+	"host": {values: func(r *http.Request, _ string) []string {
+		return []string{r.Host}
+	}},
+	"method": {values: func(r *http.Request, _ string) []string {
+		return []string{r.Method}
+	}},
+	"path": {values: func(r *http.Request, _ string) []string {
+		return []string{r.URL.Path}
+	}},
+	"scheme": {values: func(r *http.Request, _ string) []string {
+		return []string{requestScheme(r)}
+	}},
+	"contentType": {values: func(r *http.Request, _ string) []string {
+		if mediaType := requestMediaType(r); mediaType != "" {
+			return []string{mediaType}
+		}
+		return nil
+	}},
+	"header": {arg: true, values: func(r *http.Request, name string) []string {
+		return headerValues(r.Header, name)
+	}},
+	"query": {arg: true, values: func(r *http.Request, name string) []string {
+		return r.URL.Query()[name]
+	}},
+	"cookie": {arg: true, values: cookieValues},
+}
+
+// CompileMatcher builds a Matcher from a textual expression, such as
+//
+//	host ~ "google" && method == "POST" && !header("X-Debug")
+//
+// Expressions compare fields of the request with string literals:
+//
+//	field == "value"   Field is exactly value
+//	field != "value"   Field is not value
+//	field ~ "regex"    Field matches the regular expression, which is not anchored
+//	field !~ "regex"   Field does not match the regular expression
+//	field              Field is present, e.g. header("X-Debug")
+//
+// Available fields are host, method, path, scheme, contentType (without parameters), header("Name"), query("name") and
+// cookie("name"). Fields with several values, such as repeated headers, satisfy == and ~ if any of their values does,
+// and != and !~ if none of them does.
+// Comparisons can be combined with && and ||, negated with ! and grouped with parentheses, with the usual precedence.
+// true and false are also valid expressions.
+// Strings can be double-quoted, with the same escapes as Go, or enclosed in single quotes or backticks, in which case
+// they are taken verbatim, which is convenient for regular expressions.
+func CompileMatcher(expr string) (Matcher, error) {
+	tokens, err := lexExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	matcher, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.unexpected(tok)
+	}
+
+	return &exprMatcher{Matcher: matcher, expr: expr}, nil
+}
+
+// exprMatcher is a compiled expression, which describes itself with its source
+type exprMatcher struct {
+	Matcher
+	expr string
+}
+
+func (em *exprMatcher) String() string {
+	return em.expr
+}
+
+type tokenKind uint8
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenOperator
+)
+
+type exprToken struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "!~", "!", "~", "(", ")"}
+
+// lexExpr splits an expression into tokens, unquoting string literals
+func lexExpr(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isIdentChar(c) && (c < '0' || c > '9'):
+			start := i
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, value: expr[start:i], pos: start})
+
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %v", i, err)
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, value: value, pos: i})
+			i = end + 1
+
+		case c == '\'' || c == '`':
+			length := strings.IndexByte(expr[i+1:], c)
+			if length < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, value: expr[i+1 : i+1+length], pos: i})
+			i += length + 2
+
+		default:
+			operator := ""
+			for _, op := range exprOperators {
+				if strings.HasPrefix(expr[i:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, value: operator, pos: i})
+			i += len(operator)
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// exprParser is a recursive descent parser for matcher expressions. From lowest to highest precedence:
+//
+//	or      := and ("||" and)*
+//	and     := unary ("&&" unary)*
+//	unary   := "!" unary | primary
+//	primary := "(" or ")" | "true" | "false" | field [("==" | "!=" | "~" | "!~") string]
+//	field   := ident ["(" string ")"]
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the given operator
+func (p *exprParser) accept(operator string) bool {
+	if tok := p.peek(); tok.kind == tokenOperator && tok.value == operator {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *exprParser) expect(kind tokenKind, value string) (exprToken, error) {
+	tok := p.next()
+	if tok.kind != kind || (value != "" && tok.value != value) {
+		return tok, p.unexpected(tok)
+	}
+
+	return tok, nil
+}
+
+func (p *exprParser) unexpected(tok exprToken) error {
+	switch tok.kind {
+	case tokenEOF:
+		return fmt.Errorf("unexpected end of expression")
+	case tokenString:
+		return fmt.Errorf("unexpected string %q at position %d", tok.value, tok.pos)
+	}
+
+	return fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+}
+
+func (p *exprParser) or() (Matcher, error) {
+	return p.binary("||", p.and, Or)
+}
+
+func (p *exprParser) and() (Matcher, error) {
+	return p.binary("&&", p.unary, And)
+}
+
+// binary parses operands separated by operator, combining them with combine if there is more than one
+func (p *exprParser) binary(operator string, operand func() (Matcher, error), combine func(...Matcher) Matcher) (Matcher, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := []Matcher{first}
+	for p.accept(operator) {
+		m, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	if len(matchers) == 1 {
+		return first, nil
+	}
+
+	return combine(matchers...), nil
+}
+
+func (p *exprParser) unary() (Matcher, error) {
+	if p.accept("!") {
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(m), nil
+	}
+
+	return p.primary()
+}
+
+func (p *exprParser) primary() (Matcher, error) {
+	if p.accept("(") {
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenOperator, ")"); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	tok, err := p.expect(tokenIdent, "")
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok.value {
+	case "true", "false":
+		return constMatcher(tok.value == "true"), nil
+	}
+
+	field, exists := exprFields[tok.value]
+	if !exists {
+		return nil, fmt.Errorf("unknown field %q at position %d", tok.value, tok.pos)
+	}
+
+	fm := &fieldMatcher{name: tok.value, field: field}
+	if field.arg {
+		if _, err := p.expect(tokenOperator, "("); err != nil {
+			return nil, err
+		}
+		arg, err := p.expect(tokenString, "")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenOperator, ")"); err != nil {
+			return nil, err
+		}
+		fm.arg = arg.value
+	}
+
+	for _, operator := range []string{"==", "!=", "~", "!~"} {
+		if !p.accept(operator) {
+			continue
+		}
+
+		operand, err := p.expect(tokenString, "")
+		if err != nil {
+			return nil, err
+		}
+
+		fm.operator, fm.value = operator, operand.value
+		if operator == "~" || operator == "!~" {
+			fm.regex, err = regexp.Compile(operand.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex at position %d: %v", operand.pos, err)
+			}
+		}
+		break
+	}
+
+	return fm, nil
+}
+
+// fieldMatcher compares a field of the request with a value. An empty operator checks whether the field is present.
+type fieldMatcher struct {
+	name     string
+	field    exprField
+	arg      string
+	operator string
+	value    string
+	regex    *regexp.Regexp
+}
+
+func (fm *fieldMatcher) Match(r *http.Request) bool {
+	values := fm.field.values(r, fm.arg)
+
+	switch fm.operator {
+	case "":
+		return len(values) > 0
+	case "!=", "!~":
+		return !fm.any(values)
+	}
+
+	return fm.any(values)
+}
+
+// any returns true if any of the values is equal to or matches the value of the matcher
+func (fm *fieldMatcher) any(values []string) bool {
+	for _, v := range values {
+		if fm.regex != nil && fm.regex.MatchString(v) || fm.regex == nil && v == fm.value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fm *fieldMatcher) String() string {
+	field := fm.name
+	if fm.field.arg {
+		field += "(" + strconv.Quote(fm.arg) + ")"
+	}
+
+	if fm.operator == "" {
+		return field
+	}
+
+	return field + " " + fm.operator + " " + strconv.Quote(fm.value)
+}
+
+// constMatcher matches either everything or nothing
+type constMatcher bool
+
+func (cm constMatcher) Match(*http.Request) bool {
+	return bool(cm)
+}
+
+func (cm constMatcher) String() string {
+	return strconv.FormatBool(bool(cm))
+}
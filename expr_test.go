@@ -0,0 +1,94 @@
+package goxxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompileMatcher(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://www.google.com/search?q=goxxy", nil)
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{`host ~ "google" && method == "POST" && !header("X-Debug")`, true},
+		{`host ~ "google" && method == "GET"`, false},
+		{`method == "GET" || path == "/search"`, true},
+		{`method != "POST"`, false},
+		{`host !~ '^www\.'`, false},
+		{"host ~ `\\.com$`", true},
+		{`header("accept") == "application/json"`, true},
+		{`header("Accept") != "application/json"`, false},
+		{`header("Accept") ~ "xml"`, false},
+		{`header("X-Debug") != "1"`, true},
+		{`!(method == "POST" && path == "/search")`, false},
+		{`method == "GET" && path == "/nope" || host ~ "google"`, true},
+		{`!!true && !false`, true},
+		{`header("Accept")`, true},
+		{`scheme == "http" && query("q") == "goxxy" && !cookie("session")`, true},
+		{`contentType`, false},
+	} {
+		matcher, err := CompileMatcher(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+
+		if matcher.Match(req) != tc.expected {
+			t.Errorf("%s: expected %t", tc.expr, tc.expected)
+		}
+
+		if describe(matcher) != tc.expr {
+			t.Errorf("%s: described as %s", tc.expr, describe(matcher))
+		}
+	}
+}
+
+func TestCompileMatcherErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr, err string
+	}{
+		{``, "unexpected end of expression"},
+		{`host ~`, "unexpected end of expression"},
+		{`host ~ "google" &&`, "unexpected end of expression"},
+		{`(host ~ "google"`, "unexpected end of expression"},
+		{`host ~ "google")`, `unexpected ")" at position 15`},
+		{`host == google`, `unexpected "google" at position 8`},
+		{`host ~ "google" "yahoo"`, `unexpected string "yahoo" at position 16`},
+		{`ip == "127.0.0.1"`, `unknown field "ip" at position 0`},
+		{`header == "X-Debug"`, `unexpected "==" at position 7`},
+		{`host ~ "("`, "invalid regex at position 7"},
+		{`host ~ "google`, "unterminated string at position 7"},
+		{`host ~ 'google`, "unterminated string at position 7"},
+		{`host = "google"`, `unexpected character '=' at position 5`},
+	} {
+		_, err := CompileMatcher(tc.expr)
+		if err == nil {
+			t.Errorf("%s: no error returned", tc.expr)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%s: unexpected error %q", tc.expr, err)
+		}
+	}
+}
+
+func TestExprMatcherFactory(t *testing.T) {
+	matcher, err := NewMatcher("expr", func(v interface{}) error {
+		return json.Unmarshal([]byte(`{"expr": "method == \"GET\""}`), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !matcher.Match(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("Expression was not compiled")
+	}
+}
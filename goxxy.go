@@ -1,15 +1,17 @@
 package goxxy // import "roob.re/goxxy"
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-var defaultClient = &http.Client{Timeout: 8 * time.Second, CheckRedirect: noRedirectsPolicy, Jar: nil}
-var nopGoxxy = Goxxy{Client: defaultClient}
-
 // Middleware is the de-facto standard interface for http middleware: Receives a handler, and returns another (typically a closure).
 // Middlewares in Goxxy are used to modify a request before it is sent to the final server.
 type Middleware interface {
@@ -50,193 +52,674 @@ func (mf MatcherFunc) Match(r *http.Request) bool {
 	return mf(r)
 }
 
-func noRedirectsPolicy(r *http.Request, rr []*http.Request) error {
-	if len(rr) > 1 {
-		return http.ErrUseLastResponse
-	}
-	return nil
-}
-
 // Goxxy is an http proxy which applies changes to requests and responses before and after sending them to the original server.
 type Goxxy struct {
-	Client          *http.Client // http.Client Goxxy will use to send requests upstream
-	ErrHandler      http.Handler // ErrHandler will be invoked if the request made with Client fails with a non-recoverable error (e.g. NXDOMAIN, timeout, etc.)
+	Name            string          // Name identifies the node in logs and RequestContext.NodePath
+	Client          *http.Client    // If set, Client will be used as is to send requests upstream, ignoring Transport. Children share it.
+	Transport       TransportConfig // Settings used to build the client Goxxy uses to send requests upstream. Children get a copy. Requests not matched by any node use the one of the node serving them.
+	ErrHandler      http.Handler    // ErrHandler will be invoked if the request made with Client fails with a non-recoverable error (e.g. NXDOMAIN, timeout, etc.)
+	CA              *CertAuthority  // If set, CONNECT requests received by this Goxxy will be intercepted using certificates signed by CA. Otherwise, they will be tunneled untouched.
 	MangleRedirects bool
-	middlewares     []Middleware
-	manglers        []Mangler
-	matchers        []Matcher
-	children        []Goxxy
+	PreserveHost    bool                  // If upstreams are set, the Host header sent by the client will be sent upstream, instead of the upstream's host.
+	Forwarding      ForwardingHeaders     // Headers which will be added to forwarded messages. Defaults to none, see DefaultForwardingHeaders.
+	ViaName         string                // Pseudonym used in the Via header. Defaults to "goxxy".
+	OnModuleError   ErrorPolicy           // What to do when an ErrMangler or ErrMiddleware fails. Defaults to PassThrough.
+	ErrorHook       func(*ModuleError)    // If set, it is called whenever a module fails. Otherwise, errors are logged.
+	ExchangeHook    func(*RequestContext) // If set, it is called after every exchange handled by this node, or not matched by the tree if set in the root. Children inherit it.
+	Metrics         *Metrics              // If set, statistics about the requests handled by this node are collected in it. Children share it.
+	Trace           TraceOutput           // Where to report how requests are routed. Only the setting of the node requests are served by, usually the root, is used.
+	upstreams       *upstreamPool
+
+	mu            sync.RWMutex // Guards the fields below, and Client, Transport and upstreams while changed by FollowRedirects or SetUpstreams
+	middlewares   []Middleware
+	manglers      []Mangler
+	frameManglers []FrameMangler
+	matchers      []Matcher
+	children      []*Goxxy
+	disabled      bool
+
+	recent recentRequests
+
+	clientMu     sync.Mutex
+	client       *http.Client    // Client built from clientConfig
+	clientConfig TransportConfig // Transport the client was built from, to detect changes
 }
 
-// New returns a fresh instance of Goxxy, with the default HTTP Client.
+// New returns a fresh instance of Goxxy, with the default transport settings. As with a zero Goxxy, no forwarding
+// headers are added, so the client is not disclosed upstream unless Forwarding is set.
 func New() *Goxxy {
-	return &Goxxy{Client: defaultClient}
+	return &Goxxy{Transport: DefaultTransportConfig}
 }
 
 // AddMiddleware inserts a Module which will read and/or modify request before they are sent upstream
 func (g *Goxxy) AddMiddleware(mw Middleware) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	g.middlewares = append(g.middlewares, mw)
 }
 
 // AddMiddlewareFunc inserts a Module which will read and/or modify request before they are sent upstream
 func (g *Goxxy) AddMiddlewareFunc(mw MiddlewareFunc) {
-	g.middlewares = append(g.middlewares, mw)
+	g.AddMiddleware(mw)
 }
 
 // AddMangler inserts a Module which will read and/or modify responses after they're read from the target server and before they are sent back to the client
 func (g *Goxxy) AddMangler(mg Mangler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	g.manglers = append(g.manglers, mg)
 }
 
 // AddManglerFunc inserts a Module which will read and/or modify responses after they're read from the target server and before they are sent back to the client
 func (g *Goxxy) AddManglerFunc(mg ManglerFunc) {
-	g.manglers = append(g.manglers, mg)
+	g.AddMangler(mg)
+}
+
+// AddFrameMangler inserts a Module which will read and/or modify WebSocket messages relayed through upgraded connections
+func (g *Goxxy) AddFrameMangler(fm FrameMangler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.frameManglers = append(g.frameManglers, fm)
+}
+
+// AddFrameManglerFunc inserts a Module which will read and/or modify WebSocket messages relayed through upgraded connections
+func (g *Goxxy) AddFrameManglerFunc(fm FrameManglerFunc) {
+	g.AddFrameMangler(fm)
+}
+
+// AddModule inserts a module as a Middleware, Mangler and FrameMangler, depending on which of these interfaces it
+// implements. An error is returned if it implements none of them.
+func (g *Goxxy) AddModule(module interface{}) error {
+	mw, isMiddleware := module.(Middleware)
+	mg, isMangler := module.(Mangler)
+	fm, isFrameMangler := module.(FrameMangler)
+	if !isMiddleware && !isMangler && !isFrameMangler {
+		return fmt.Errorf("%s is not a Middleware, Mangler or FrameMangler", ModuleName(module))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if isMiddleware {
+		g.middlewares = append(g.middlewares, mw)
+	}
+	if isMangler {
+		g.manglers = append(g.manglers, mg)
+	}
+	if isFrameMangler {
+		g.frameManglers = append(g.frameManglers, fm)
+	}
+
+	return nil
 }
 
 // Match adds a new matcher, which can discern if a request should be handled by this proxy or not. Multiple Matchers are OR'ed together.
 // A Goxxy with no Matchers will match anything, but give priority to its children.
 func (g *Goxxy) Match(m Matcher) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	g.matchers = append(g.matchers, m)
 }
 
 // MatchFunc adds a new matcher, which can discern if a request should be handled by this proxy or not. Multiple Matchers are OR'ed together.
 func (g *Goxxy) MatchFunc(m MatcherFunc) {
-	g.matchers = append(g.matchers, m)
+	g.Match(m)
+}
+
+// Matchers returns the matchers of g
+func (g *Goxxy) Matchers() []Matcher {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append([]Matcher(nil), g.matchers...)
+}
+
+// Middlewares returns the middlewares of g, in the order they are applied
+func (g *Goxxy) Middlewares() []Middleware {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append([]Middleware(nil), g.middlewares...)
+}
+
+// Manglers returns the manglers of g, in the order they are applied
+func (g *Goxxy) Manglers() []Mangler {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append([]Mangler(nil), g.manglers...)
+}
+
+// FrameManglers returns the frame manglers of g, in the order they are applied
+func (g *Goxxy) FrameManglers() []FrameMangler {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append([]FrameMangler(nil), g.frameManglers...)
+}
+
+// Children returns the children of g, in order of precedence
+func (g *Goxxy) Children() []*Goxxy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append([]*Goxxy(nil), g.children...)
+}
+
+// RemoveMatcher removes the matcher at index i, as returned by Matchers. Requests being served are not affected.
+func (g *Goxxy) RemoveMatcher(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if i < 0 || i >= len(g.matchers) {
+		return fmt.Errorf("no matcher with index %d", i)
+	}
+
+	// Slices may be in use by requests being served, so a new one is always allocated
+	g.matchers = append(g.matchers[:i:i], g.matchers[i+1:]...)
+	return nil
+}
+
+// RemoveMiddleware removes the middleware at index i, as returned by Middlewares. Requests being served are not affected.
+func (g *Goxxy) RemoveMiddleware(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if i < 0 || i >= len(g.middlewares) {
+		return fmt.Errorf("no middleware with index %d", i)
+	}
+
+	g.middlewares = append(g.middlewares[:i:i], g.middlewares[i+1:]...)
+	return nil
+}
+
+// RemoveMangler removes the mangler at index i, as returned by Manglers. Requests being served are not affected.
+func (g *Goxxy) RemoveMangler(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if i < 0 || i >= len(g.manglers) {
+		return fmt.Errorf("no mangler with index %d", i)
+	}
+
+	g.manglers = append(g.manglers[:i:i], g.manglers[i+1:]...)
+	return nil
+}
+
+// RemoveFrameMangler removes the frame mangler at index i, as returned by FrameManglers. Connections already upgraded
+// are not affected.
+func (g *Goxxy) RemoveFrameMangler(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if i < 0 || i >= len(g.frameManglers) {
+		return fmt.Errorf("no frame mangler with index %d", i)
+	}
+
+	g.frameManglers = append(g.frameManglers[:i:i], g.frameManglers[i+1:]...)
+	return nil
+}
+
+// SetEnabled enables or disables g. Disabled nodes, and therefore their children, do not match any request.
+// A disabled root leaves every request intact.
+func (g *Goxxy) SetEnabled(enabled bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.disabled = !enabled
+}
+
+// Enabled returns false if g has been disabled with SetEnabled
+func (g *Goxxy) Enabled() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return !g.disabled
 }
 
 // Child creates adds a new child Goxxy and returns it.
+// The child inherits the upstream settings of g at the time of the call. Later changes to g are not propagated.
 func (g *Goxxy) Child() *Goxxy {
-	g.children = append(g.children, Goxxy{Client: g.Client, ErrHandler: g.ErrHandler})
-	return &g.children[len(g.children)-1]
+	client, transport, upstreams := g.upstreamSettings()
+	child := &Goxxy{
+		Client:        client,
+		Transport:     transport,
+		ErrHandler:    g.ErrHandler,
+		PreserveHost:  g.PreserveHost,
+		Forwarding:    g.Forwarding,
+		ViaName:       g.ViaName,
+		OnModuleError: g.OnModuleError,
+		ErrorHook:     g.ErrorHook,
+		ExchangeHook:  g.ExchangeHook,
+		Metrics:       g.Metrics,
+		upstreams:     upstreams,
+	}
+
+	g.mu.Lock()
+	g.children = append(g.children, child)
+	g.mu.Unlock()
+
+	return child
 }
 
-// Goxxy won't follow redirects by default, since it can be breaking in some scenarios.
+// Goxxy won't follow redirects by default, since it can be breaking in some scenarios: a single redirect is followed,
+// and the next one is sent back to the client.
 // However, enabling it will reduce latency and bandwith usage between goxxy and the clients.
+// If g has an explicit Client, it is replaced by a copy, so other nodes sharing it are not affected.
 func (g *Goxxy) FollowRedirects(follow bool) {
-	if follow {
-		g.Client.CheckRedirect = nil
-	} else {
-		g.Client.CheckRedirect = noRedirectsPolicy
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.Transport.FollowRedirects = follow
+
+	if g.Client != nil {
+		client := *g.Client
+		client.CheckRedirect = g.Transport.checkRedirect()
+		g.Client = &client
 	}
 }
 
 // Mangle returns a response after applying all manglers to the original one.
 // Mangle is exported so Goxxy implements Mangler if needed, but it is not intended to be used from the outside in normal cases
+// Errors returned by ErrManglers are reported and handled as in the PassThrough policy, regardless of OnModuleError:
+// the failing mangler is skipped and the remaining ones are applied.
 func (g *Goxxy) Mangle(response *http.Response) *http.Response {
+	mangled, _ := g.mangle(response, PassThrough)
+	return mangled
+}
+
+// mangle applies all manglers to the response. If an ErrMangler fails and policy is not PassThrough, the response
+// as it was before the failing mangler is returned along with the error.
+func (g *Goxxy) mangle(response *http.Response, policy ErrorPolicy) (*http.Response, error) {
 	// Do not invoke manglers if it's a redirect and MangleRedirects == false
-	if g.MangleRedirects || !(response.StatusCode >= 300 && response.StatusCode < 400) {
-		for i := range g.manglers {
-			response = g.manglers[i].Mangle(response)
+	if !g.MangleRedirects && response.StatusCode >= 300 && response.StatusCode < 400 {
+		return response, nil
+	}
+
+	g.mu.RLock()
+	manglers := g.manglers
+	g.mu.RUnlock()
+
+	rc := FromResponse(response)
+	for _, mangler := range manglers {
+		start := time.Now()
+		before := snapshotResponse(rc, response)
+
+		var mangled *http.Response
+		var err error
+		if errMangler, isErrMangler := mangler.(ErrMangler); isErrMangler {
+			// Failing manglers may have changed the response in place before giving up, which must be undone
+			status, header, length := response.StatusCode, cloneHeader(response.Header), response.ContentLength
+			body := recordBody(response)
+			mangled, err = errMangler.MangleErr(response)
+			if err != nil {
+				response.StatusCode = status
+				restoreHeader(response.Header, header)
+				response.ContentLength = length
+				body.restore(response)
+			} else {
+				body.stop(mangled)
+			}
+		} else {
+			mangled = mangler.Mangle(response)
+		}
+		g.Metrics.observeMangler(response.Request, mangler, start)
+
+		if err != nil {
+			me := &ModuleError{Module: mangler, Node: g, Request: response.Request, Err: err}
+			g.report(me)
+			if policy != PassThrough {
+				return response, me
+			}
+			continue
 		}
+
+		before.record(mangled, mangler)
+		response = mangled
 	}
 
-	return response
+	return response, nil
 }
 
 // Middleware returns the provided handler wrapped around g.middlewares
 func (g *Goxxy) Middleware(handler http.Handler) http.Handler {
-	for i := len(g.middlewares) - 1; i >= 0; i-- {
-		handler = g.middlewares[i].Middleware(handler)
+	g.mu.RLock()
+	middlewares := g.middlewares
+	g.mu.RUnlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if errMiddleware, isErrMiddleware := middlewares[i].(ErrMiddleware); isErrMiddleware {
+			handler = g.errMiddleware(errMiddleware, handler)
+			continue
+		}
+		handler = middlewares[i].Middleware(handler)
 	}
 
 	return handler
 }
 
-// ServeHTTP finds the appropiate Goxxy with demux(), wraps its proxy() with its Middleware() and calls it
+// errMiddleware returns a handler which calls an ErrMiddleware before the next handler, applying g.OnModuleError if it fails
+func (g *Goxxy) errMiddleware(mw ErrMiddleware, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := mw.MiddlewareErr(r); err != nil {
+			g.report(&ModuleError{Module: mw, Node: g, Request: r, Err: err})
+			if g.OnModuleError != PassThrough {
+				g.moduleFailed(rw)
+				return
+			}
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ServeHTTP finds the appropiate Goxxy with route(), wraps its proxy() with its Middleware() and calls it
+// CONNECT requests are either intercepted, if g.CA is set, or tunneled. Intercepted requests are fed back to ServeHTTP.
 func (g *Goxxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	handlerGoxxy := g.demux(r)
+	if r.Method == http.MethodConnect {
+		g.serveConnect(rw, r)
+		return
+	}
+
+	rc := &RequestContext{Start: time.Now()}
+	var trace *RouteTrace
+	if g.Trace != 0 {
+		trace = &RouteTrace{Node: g.label(-1)}
+	}
+	rc.Path, rc.labels = g.route(r, g.label(-1), trace)
+	if trace != nil {
+		g.reportTrace(rw, r, trace)
+	}
+	r = withRequestContext(r, rc)
+	rw = meter(rw, r, rc)
 
+	handlerGoxxy := rc.Node()
 	if handlerGoxxy == nil {
 		log.Printf("Nothing matched `%s`, leaving intact", r.Method+" "+r.Host+r.RequestURI)
-		nopGoxxy.proxy(rw, r)
+		g.passthrough().proxy(rw, r)
+		g.Metrics.observeRequest(rc)
+		if g.ExchangeHook != nil {
+			g.ExchangeHook(rc)
+		}
 		return
 	}
 
+	if handlerGoxxy.ExchangeHook != nil {
+		rc.TrackChanges = true
+	}
+
 	handlerGoxxy.Middleware(http.HandlerFunc(handlerGoxxy.proxy)).ServeHTTP(rw, r)
+	handlerGoxxy.Metrics.observeRequest(rc)
+	handlerGoxxy.recent.add(rc)
+	if handlerGoxxy.ExchangeHook != nil {
+		handlerGoxxy.ExchangeHook(rc)
+	}
 }
 
-// Demux looks at matchers and children and returns a pointer to the Goxxy that should manage a given request
+// demux looks at matchers and children and returns a pointer to the Goxxy that should manage a given request
 func (g *Goxxy) demux(r *http.Request) *Goxxy {
-	var handler *Goxxy = nil
+	path, _ := g.route(r, "", nil)
+	if len(path) == 0 {
+		return nil
+	}
 
-	if len(g.matchers) == 0 {
-		if len(g.children) == 0 {
-			// Return inmediately if empty
-			return g
-		}
-		// Default as myself if no matchers
-		handler = g
-	} else {
-		// Store myself if I match
-		for _, c := range g.matchers {
-			if c.Match(r) {
-				handler = g
-				break
-			}
-		}
+	return path[len(path)-1]
+}
 
-		// Return if non-empty list of matchers and not matched any
-		if handler == nil {
-			return nil
+// route returns the path of nodes from g to the deepest one matching the request, or nil if g does not match.
+// A Goxxy with no matchers matches anything, and the first matching child takes precedence over its parent.
+// Disabled nodes never match.
+// Labels for each node in the path are returned along with it, label being the one for g.
+// If trace is not nil, the decisions taken are recorded in it. Its Node must be already set.
+func (g *Goxxy) route(r *http.Request, label string, trace *RouteTrace) ([]*Goxxy, []string) {
+	g.mu.RLock()
+	matchers, children, disabled := g.matchers, g.children, g.disabled
+	g.mu.RUnlock()
+
+	if disabled {
+		if trace != nil {
+			trace.Disabled = true
 		}
+		return nil, nil
 	}
 
-	// Overwrite with children if they match
-	for i := range g.children {
-		child := &g.children[i]
-		if childHandler := child.demux(r); childHandler != nil {
-			handler = childHandler
+	matched := len(matchers) == 0
+	for _, m := range matchers {
+		result := m.Match(r)
+		if trace != nil {
+			trace.Matchers = append(trace.Matchers, MatcherTrace{Matcher: describe(m), Matched: result})
+		}
+		if result {
+			matched = true
 			break
 		}
 	}
 
-	return handler
+	if trace != nil {
+		trace.Matched = matched
+	}
+
+	if !matched {
+		return nil, nil
+	}
+
+	for i, child := range children {
+		var childTrace *RouteTrace
+		if trace != nil {
+			childTrace = &RouteTrace{Node: trace.Node + "/" + child.label(i)}
+			trace.Children = append(trace.Children, childTrace)
+		}
+
+		if path, labels := child.route(r, child.label(i), childTrace); path != nil {
+			if trace != nil {
+				for j := i + 1; j < len(children); j++ {
+					trace.Children = append(trace.Children, &RouteTrace{Node: trace.Node + "/" + children[j].label(j), Skipped: true})
+				}
+			}
+			return append([]*Goxxy{g}, path...), append([]string{label}, labels...)
+		}
+	}
+
+	if trace != nil {
+		trace.Handles = true
+	}
+
+	return []*Goxxy{g}, []string{label}
+}
+
+// label returns the name of the node, or its index among its siblings if it has none. The root has index -1.
+func (g *Goxxy) label(index int) string {
+	if g.Name != "" {
+		return g.Name
+	}
+
+	if index < 0 {
+		return "root"
+	}
+
+	return strconv.Itoa(index)
 }
 
 // proxy makes a request to the upstream servers, mangles it, and echoes the response to the writer
 func (g *Goxxy) proxy(rw http.ResponseWriter, r *http.Request) {
-	var url string
-	if r.TLS != nil {
-		url += "https://"
-	} else {
-		url += "http://"
+	if isUpgrade(r.Header) {
+		g.proxyUpgrade(rw, r)
+		return
+	}
+
+	rc := FromRequest(r)
+	if rc != nil {
+		rc.UpstreamStart = time.Now()
+	}
+
+	response, err := g.upstreamClient().Do(g.forwardInformational(rw, g.upstreamRequest(r)))
+	if rc != nil {
+		rc.UpstreamEnd = time.Now()
+	}
+	g.Metrics.observeUpstream(rc, err)
+	if err != nil {
+		g.upstreamError(rw, r, err)
+		return
 	}
 
-	url += r.Host + r.RequestURI
+	g.respond(rw, response)
+}
 
-	newreq, _ := http.NewRequest(r.Method, url, r.Body)
-	newreq.Header = r.Header
+// respond mangles a response received from upstream and sends it to the client
+func (g *Goxxy) respond(rw http.ResponseWriter, response *http.Response) {
+	g.prepareResponse(response)
 
-	response, err := g.Client.Do(newreq)
+	mangled, err := g.mangle(response, g.OnModuleError)
 	if err != nil {
-		// Use custom handler if set
-		if g.ErrHandler != nil {
-			g.ErrHandler.ServeHTTP(rw, r)
-			return
-		}
+		response.Body.Close()
+		g.moduleFailed(rw)
+		return
+	}
 
-		// This is a low-level error, so we just hijack the connection and forcefully close it
-		if hijacker, isHijacker := rw.(http.Hijacker); isHijacker {
-			conn, _, _ := hijacker.Hijack()
-			conn.Close()
-			return
-		}
+	copyResponse(rw, mangled)
+}
+
+// upstreamRequest builds the request which will be sent upstream from the one received from the client
+func (g *Goxxy) upstreamRequest(r *http.Request) *http.Request {
+	url, host := g.upstreamURL(r)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		log.Printf("error during request: %v", err)
+	newreq, _ := http.NewRequest(r.Method, url.String(), r.Body)
+	newreq = newreq.WithContext(r.Context())
+	newreq.ContentLength = r.ContentLength
+	newreq.Trailer = r.Trailer
+	newreq.Header = cloneHeader(r.Header)
+	newreq.Host = host
+
+	removeHopByHop(newreq.Header)
+	g.addForwardingHeaders(newreq.Header, r)
+
+	return newreq
+}
+
+// prepareResponse removes hop-by-hop headers from a response received from upstream, and adds forwarding headers if enabled.
+func (g *Goxxy) prepareResponse(response *http.Response) {
+	removeHopByHop(response.Header)
+
+	if g.Forwarding&HeaderViaResponse != 0 {
+		response.Header.Add("Via", g.via(response.ProtoMajor, response.ProtoMinor))
+	}
+}
+
+// upstreamError handles a failed request to the upstream server
+func (g *Goxxy) upstreamError(rw http.ResponseWriter, r *http.Request, err error) {
+	// Use custom handler if set
+	if g.ErrHandler != nil {
+		g.ErrHandler.ServeHTTP(rw, r)
+		return
+	}
+
+	// This is a low-level error, so we just hijack the connection and forcefully close it
+	if abortConnection(rw) {
 		return
 	}
 
-	copyResponse(rw, g.Mangle(response))
+	rw.WriteHeader(http.StatusInternalServerError)
+	log.Printf("error during request: %v", err)
 }
 
+// copyResponse sends a response to the client.
+// Responses of unknown length, such as chunked streams, and event streams are flushed as data arrives, so clients
+// are not kept waiting. Trailers are announced in the headers and sent after the body. Responses to HEAD requests, and
+// those with statuses which cannot have one, are sent without body.
 func copyResponse(rw http.ResponseWriter, response *http.Response) {
+	header := rw.Header()
 	for name, values := range response.Header {
 		for _, value := range values {
-			rw.Header().Add(name, value)
+			header.Add(name, value)
+		}
+	}
+
+	// Trailer names are known at this point, but their values are only available once the body is read
+	announced := len(response.Trailer)
+	if announced > 0 {
+		names := make([]string, 0, announced)
+		for name := range response.Trailer {
+			names = append(names, name)
 		}
+		header.Add("Trailer", strings.Join(names, ", "))
 	}
 
 	rw.WriteHeader(response.StatusCode)
-	io.Copy(rw, response.Body)
+
+	if response.Body == nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if !BodyAllowed(response) {
+		return
+	}
+
+	if streaming(response) {
+		copyFlushing(rw, response.Body)
+	} else {
+		io.Copy(rw, response.Body)
+	}
+
+	if len(response.Trailer) == announced {
+		for name, values := range response.Trailer {
+			header[name] = values
+		}
+		return
+	}
+
+	// Trailers which were not announced must be flagged as such
+	for name, values := range response.Trailer {
+		header[http.TrailerPrefix+name] = values
+	}
+}
+
+// BodyAllowed returns false for responses which must not have a body, as in RFC 7230, section 3.3.3: responses to HEAD
+// requests and those with a 1xx, 204 or 304 status. Manglers rewriting bodies can use it to leave those untouched.
+func BodyAllowed(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+
+	status := response.StatusCode
+	informational := status >= 100 && status < 200
+	return !informational && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// streaming returns true if the response should be flushed as it is received
+func streaming(response *http.Response) bool {
+	if response.ContentLength < 0 {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// copyFlushing copies body to rw, flushing after every read
+func copyFlushing(rw http.ResponseWriter, body io.Reader) {
+	flusher, isFlusher := rw.(http.Flusher)
+	if !isFlusher {
+		io.Copy(rw, body)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		if err != nil {
+			return
+		}
+	}
 }
@@ -2,8 +2,12 @@ package goxxy_test
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"roob.re/goxxy"
 	"roob.re/goxxy/tests"
@@ -49,3 +53,78 @@ func TestIdentity(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestConnectIntercept(t *testing.T) {
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(tests.HTMLHandler))
+	defer tlsUpstream.Close()
+
+	ca, err := goxxy.GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := goxxy.New()
+	g.Client = tlsUpstream.Client()
+	g.CA = ca
+	g.AddManglerFunc(func(response *http.Response) *http.Response {
+		response.Header.Set("X-Intercepted", response.Request.URL.Scheme)
+		return response
+	})
+
+	proxy := httptest.NewServer(g)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	proxyClient := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+
+	response, err := proxyClient.Get(tlsUpstream.URL + "/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.TLS == nil || response.TLS.PeerCertificates[0].Issuer.CommonName != "Goxxy test CA" {
+		t.Error("Connection was not intercepted with the supplied CA")
+	}
+
+	if response.Header.Get("X-Intercepted") != "https" {
+		t.Error("Intercepted request did not go through manglers")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if !bytes.Equal(body, []byte(tests.ResponseHTML)) {
+		t.Error("Response body differs")
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(tests.HTMLHandler))
+	defer tlsUpstream.Close()
+
+	proxy := httptest.NewServer(goxxy.New())
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := tlsUpstream.Client().Transport.(*http.Transport)
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	response, err := (&http.Client{Transport: transport}).Get(tlsUpstream.URL + "/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.TLS.PeerCertificates[0].Issuer.CommonName == "Goxxy test CA" {
+		t.Error("Tunneled connection was intercepted")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if !bytes.Equal(body, []byte(tests.ResponseHTML)) {
+		t.Error("Response body differs")
+	}
+}
@@ -1,14 +1,19 @@
 package goxxy
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"roob.re/goxxy/tests"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGoxxy(t *testing.T) {
@@ -207,3 +212,142 @@ func TestMiddleware(t *testing.T) {
 		t.Errorf("First+Second+Abort middleware did not apply, got: %s", string(rec.Body.Bytes()))
 	}
 }
+
+func TestCopyResponseStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Content-Length", "32")
+		rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		rw.Write([]byte("data: second\n\n\n\n\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	proxy := httptest.NewServer(New())
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	response, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	line := make(chan string)
+	go func() {
+		l, _ := bufio.NewReader(response.Body).ReadString('\n')
+		line <- l
+	}()
+
+	select {
+	case l := <-line:
+		if l != "data: first\n" {
+			t.Errorf("Unexpected event %q", l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Event was not flushed to the client")
+	}
+}
+
+func TestCopyResponseTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Header().Set("Trailer", "X-Announced")
+		rw.Write(body)
+		rw.Header().Set("X-Announced", "announced")
+		rw.Header().Set(http.TrailerPrefix+"X-Unannounced", "unannounced")
+		rw.Header().Set(http.TrailerPrefix+"X-Request-Trailer", r.Trailer.Get("X-Request-Trailer"))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(New())
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL, ioutil.NopCloser(strings.NewReader("body")))
+	req.ContentLength = -1
+	req.Trailer = http.Header{"X-Request-Trailer": {"from client"}}
+
+	response, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(body) != "body" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	for name, expected := range map[string]string{"X-Announced": "announced", "X-Unannounced": "unannounced", "X-Request-Trailer": "from client"} {
+		if value := response.Trailer.Get(name); value != expected {
+			t.Errorf("Trailer %s: expected %q, got %q", name, expected, value)
+		}
+	}
+}
+
+func TestCopyResponseWithoutBody(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodHead, http.StatusOK},
+		{http.MethodGet, http.StatusNoContent},
+		{http.MethodGet, http.StatusNotModified},
+	} {
+		response := &http.Response{
+			StatusCode: tc.status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("should not be sent")),
+			Request:    httptest.NewRequest(tc.method, "/", nil),
+		}
+
+		rec := httptest.NewRecorder()
+		copyResponse(rec, response)
+		if rec.Code != tc.status || rec.Body.Len() != 0 {
+			t.Errorf("%s with status %d: body was sent", tc.method, tc.status)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Error("Expect header was not forwarded")
+		}
+		io.Copy(rw, r.Body)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(New())
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), ExpectContinueTimeout: 5 * time.Second}}
+
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL, strings.NewReader("body"))
+	req.Header.Set("Expect", "100-continue")
+
+	start := time.Now()
+	response, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(body) != "body" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	if time.Since(start) > 4*time.Second {
+		t.Error("Client waited for the timeout instead of receiving 100 Continue")
+	}
+}
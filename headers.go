@@ -0,0 +1,164 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardingHeaders is a set of flags controlling which headers Goxxy adds to the messages it forwards, disclosing
+// itself and the client. They can be combined with |, and a value of 0 makes Goxxy fully transparent.
+type ForwardingHeaders uint8
+
+const (
+	HeaderXForwardedFor   ForwardingHeaders = 1 << iota // Append the client address to X-Forwarded-For
+	HeaderXForwardedProto                               // Set X-Forwarded-Proto to the scheme used by the client, if not present
+	HeaderXForwardedHost                                // Set X-Forwarded-Host to the host requested by the client, if not present
+	HeaderForwarded                                     // Append an element to the Forwarded header, as in RFC 7239
+	HeaderVia                                           // Append Goxxy to the Via header of requests
+	HeaderViaResponse                                   // Append Goxxy to the Via header of responses
+
+	// DefaultForwardingHeaders are the headers usually added by reverse proxies. They are not enabled by default, as they
+	// disclose the address of the client, and must be set in Goxxy.Forwarding explicitly.
+	DefaultForwardingHeaders = HeaderXForwardedFor | HeaderXForwardedProto | HeaderXForwardedHost | HeaderVia
+)
+
+const defaultViaName = "goxxy"
+
+// hopByHopHeaders are meaningful only for a single transport-level connection, and must not be forwarded by proxies.
+// Trailer is not included, as trailers are forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop removes hop-by-hop headers, including those listed in Connection, as specified in RFC 7230, section 6.1.
+// "TE: trailers" is kept, as some protocols (e.g. gRPC) require it end-to-end.
+func removeHopByHop(header http.Header) {
+	teTrailers := headerHasToken(header, "Te", "trailers")
+
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	if teTrailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// headerValues returns every value of the header called name. Names are compared case-insensitively, so values stored
+// under non-canonical keys, e.g. by code setting the header map directly, are found as well.
+func headerValues(header http.Header, name string) []string {
+	var values []string
+	for key, v := range header {
+		if strings.EqualFold(key, name) {
+			values = append(values, v...)
+		}
+	}
+
+	return values
+}
+
+// cloneHeader returns a deep copy of header
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+
+	return clone
+}
+
+// restoreHeader makes header equal to snapshot, changing it in place
+func restoreHeader(header, snapshot http.Header) {
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range snapshot {
+		header[name] = values
+	}
+}
+
+// addForwardingHeaders adds the headers enabled in g.Forwarding to the request which will be sent upstream
+func (g *Goxxy) addForwardingHeaders(header http.Header, r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	if g.Forwarding&HeaderXForwardedFor != 0 && clientIP != "" {
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+
+	if g.Forwarding&HeaderXForwardedProto != 0 && header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if g.Forwarding&HeaderXForwardedHost != 0 && header.Get("X-Forwarded-Host") == "" && r.Host != "" {
+		header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	if g.Forwarding&HeaderForwarded != 0 {
+		var element []string
+		if clientIP != "" {
+			if strings.Contains(clientIP, ":") {
+				// IPv6 addresses must be quoted and enclosed in brackets
+				element = append(element, fmt.Sprintf(`for="[%s]"`, clientIP))
+			} else {
+				element = append(element, "for="+clientIP)
+			}
+		}
+		if r.Host != "" {
+			element = append(element, fmt.Sprintf("host=%q", r.Host))
+		}
+		element = append(element, "proto="+proto)
+
+		header.Add("Forwarded", strings.Join(element, ";"))
+	}
+
+	if g.Forwarding&HeaderVia != 0 {
+		header.Add("Via", g.via(r.ProtoMajor, r.ProtoMinor))
+	}
+}
+
+// via returns the value Goxxy appends to the Via header
+func (g *Goxxy) via(major, minor int) string {
+	name := g.ViaName
+	if name == "" {
+		name = defaultViaName
+	}
+
+	if major == 0 {
+		major, minor = 1, 1
+	}
+
+	if major > 1 {
+		return fmt.Sprintf("%d %s", major, name)
+	}
+
+	return fmt.Sprintf("%d.%d %s", major, minor, name)
+}
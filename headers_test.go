@@ -0,0 +1,117 @@
+package goxxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy/tests"
+	"testing"
+)
+
+func TestRemoveHopByHop(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "keep-alive, X-Custom-Hop")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("X-Custom-Hop", "1")
+	header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	header.Set("Upgrade", "websocket")
+	header.Set("Te", "trailers, deflate")
+	header.Set("X-End-To-End", "1")
+
+	removeHopByHop(header)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Custom-Hop", "Proxy-Authorization", "Upgrade"} {
+		if _, present := header[name]; present {
+			t.Errorf("Hop-by-hop header %s was not removed", name)
+		}
+	}
+
+	if header.Get("Te") != "trailers" {
+		t.Errorf("TE: trailers was not preserved, got %q", header.Get("Te"))
+	}
+
+	if header.Get("X-End-To-End") != "1" {
+		t.Error("End-to-end header was removed")
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	r := tests.Get()
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.168.0.1")
+
+	g := New()
+	header := cloneHeader(r.Header)
+	g.addForwardingHeaders(header, r)
+
+	if header.Get("X-Forwarded-For") != "192.168.0.1" || header.Get("Via") != "" {
+		t.Errorf("Forwarding headers added by default: %v", header)
+	}
+
+	g.Forwarding = DefaultForwardingHeaders
+	header = cloneHeader(r.Header)
+	g.addForwardingHeaders(header, r)
+
+	if header.Get("X-Forwarded-For") != "192.168.0.1, 10.0.0.1" {
+		t.Errorf("Unexpected X-Forwarded-For: %s", header.Get("X-Forwarded-For"))
+	}
+	if header.Get("X-Forwarded-Proto") != "http" || header.Get("X-Forwarded-Host") != "www.example.org" {
+		t.Errorf("Unexpected X-Forwarded-Proto or -Host: %v", header)
+	}
+	if header.Get("Via") != "1.1 goxxy" {
+		t.Errorf("Unexpected Via: %s", header.Get("Via"))
+	}
+	if header.Get("Forwarded") != "" {
+		t.Error("Forwarded added despite not being enabled")
+	}
+
+	g.Forwarding = HeaderForwarded
+	g.ViaName = "stealth"
+	r.RemoteAddr = "[::1]:1234"
+	header = cloneHeader(r.Header)
+	g.addForwardingHeaders(header, r)
+
+	if header.Get("Forwarded") != `for="[::1]";host="www.example.org";proto=http` {
+		t.Errorf("Unexpected Forwarded: %s", header.Get("Forwarded"))
+	}
+	if header.Get("Via") != "" || header.Get("X-Forwarded-Host") != "" || header.Get("X-Forwarded-For") != "192.168.0.1" {
+		t.Errorf("Disabled headers were added: %v", header)
+	}
+}
+
+func TestHopByHopProxied(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		rw.Header().Set("Connection", "X-Upstream-Hop")
+		rw.Header().Set("X-Upstream-Hop", "1")
+	}))
+	defer upstream.Close()
+
+	g := New()
+	g.Forwarding = HeaderViaResponse
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+
+	if received.Get("X-Client-Hop") != "" || received.Get("Proxy-Authorization") != "" {
+		t.Errorf("Hop-by-hop headers leaked upstream: %v", received)
+	}
+	if received.Get("X-Forwarded-For") != "" || received.Get("Via") != "" {
+		t.Errorf("Disabled forwarding headers sent upstream: %v", received)
+	}
+	if req.Header.Get("X-Client-Hop") == "" {
+		t.Error("Headers of the original request were modified")
+	}
+
+	response := rec.Result()
+	if response.Header.Get("X-Upstream-Hop") != "" {
+		t.Errorf("Hop-by-hop headers leaked to the client: %v", response.Header)
+	}
+	if response.Header.Get("Via") != "1.1 goxxy" {
+		t.Errorf("Via not added to response: %v", response.Header)
+	}
+}
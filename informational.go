@@ -0,0 +1,37 @@
+//go:build go1.19
+// +build go1.19
+
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// forwardInformational returns req with a trace which relays the 1xx responses received from upstream to the client,
+// such as 103 Early Hints. 100 Continue is not relayed, as http.Server sends it by itself when the handler starts
+// reading the request body, which happens when upstream asks for it.
+func (g *Goxxy) forwardInformational(rw http.ResponseWriter, req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+
+			h := rw.Header()
+			for name, values := range header {
+				h[name] = values
+			}
+			rw.WriteHeader(code)
+
+			// Headers of informational responses must not leak into the final one
+			for name := range header {
+				delete(h, name)
+			}
+			return nil
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,14 @@
+//go:build !go1.19
+// +build !go1.19
+
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"net/http"
+)
+
+// forwardInformational returns req untouched. http.ResponseWriter cannot send 1xx responses before Go 1.19, so
+// informational responses from upstream are dropped.
+func (g *Goxxy) forwardInformational(rw http.ResponseWriter, req *http.Request) *http.Request {
+	return req
+}
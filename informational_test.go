@@ -0,0 +1,64 @@
+//go:build go1.19
+// +build go1.19
+
+package goxxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"testing"
+)
+
+func TestInformationalResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Link", "</style.css>; rel=preload")
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Del("Link")
+		rw.Write([]byte("final"))
+	}))
+	defer upstream.Close()
+
+	g := New()
+	var status int
+	g.ExchangeHook = func(rc *RequestContext) {
+		status = rc.Status
+	}
+
+	proxy := httptest.NewServer(g)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	var hints textproto.MIMEHeader
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = header
+			}
+			return nil
+		},
+	}))
+
+	response, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if hints == nil || hints.Get("Link") != "</style.css>; rel=preload" {
+		t.Errorf("Early hints were not relayed: %v", hints)
+	}
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Link") != "" {
+		t.Error("Headers of the informational response leaked into the final one")
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("Informational status recorded as the final one: %d", status)
+	}
+}
@@ -1,28 +1,624 @@
 package goxxy // import "roob.re/goxxy"
 
 import (
+	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	"regexp"
+	"strings"
 )
 
+func init() {
+	RegisterMatcher("header", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Name  string `json:"name" yaml:"name"`
+			Value string `json:"value" yaml:"value"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		regex, err := regexp.Compile(params.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		return &headerMatcher{name: params.Name, regex: regex}, nil
+	})
+
+	RegisterMatcher("host", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Host string `json:"host" yaml:"host"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		regex, err := regexp.Compile(params.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		return &hostMatcher{regex: regex}, nil
+	})
+
+	RegisterMatcher("expr", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Expr string `json:"expr" yaml:"expr"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return CompileMatcher(params.Expr)
+	})
+
+	RegisterMatcher("path", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Regex string `json:"regex" yaml:"regex"`
+			Glob  string `json:"glob" yaml:"glob"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case params.Regex != "" && params.Glob != "":
+			return nil, fmt.Errorf("only one of regex and glob can be set")
+		case params.Glob != "":
+			return PathGlobMatcher(params.Glob)
+		}
+
+		return PathMatcher(params.Regex)
+	})
+
+	RegisterMatcher("method", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Methods []string `json:"methods" yaml:"methods"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return MethodMatcher(params.Methods...)
+	})
+
+	RegisterMatcher("query", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Name  string `json:"name" yaml:"name"`
+			Value string `json:"value" yaml:"value"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return QueryMatcher(params.Name, params.Value)
+	})
+
+	RegisterMatcher("cookie", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Name  string `json:"name" yaml:"name"`
+			Value string `json:"value" yaml:"value"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return CookieMatcher(params.Name, params.Value)
+	})
+
+	RegisterMatcher("cidr", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			CIDRs []string `json:"cidrs" yaml:"cidrs"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return CIDRMatcher(params.CIDRs...)
+	})
+
+	RegisterMatcher("scheme", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Scheme string `json:"scheme" yaml:"scheme"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return SchemeMatcher(params.Scheme)
+	})
+
+	RegisterMatcher("contentType", func(decode Decoder) (Matcher, error) {
+		var params struct {
+			Types []string `json:"types" yaml:"types"`
+		}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return ContentTypeMatcher(params.Types...)
+	})
+
+	RegisterMatcher("bodySize", func(decode Decoder) (Matcher, error) {
+		params := struct {
+			Min int64 `json:"min" yaml:"min"`
+			Max int64 `json:"max" yaml:"max"`
+		}{Max: -1}
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+
+		return BodySizeMatcher(params.Min, params.Max)
+	})
+}
+
+// HeaderMatcher returns a Matcher which matches requests with a header called name, compared case-insensitively, any
+// of whose values matches valueRegex. It panics if the regex is invalid, so patterns not known in advance should be built with NewMatcher or CompileMatcher.
 func HeaderMatcher(name, valueRegex string) Matcher {
-	// TODO: Proper error log
-	regex := regexp.MustCompile(valueRegex)
-	return MatcherFunc(func(r *http.Request) bool {
-		for headerName, value := range r.Header {
-			if name == headerName && regex.MatchString(value[0]) {
-				return true
+	return &headerMatcher{name: name, regex: regexp.MustCompile(valueRegex)}
+}
+
+type headerMatcher struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+func (hm *headerMatcher) Match(r *http.Request) bool {
+	return anyMatches(hm.regex, headerValues(r.Header, hm.name))
+}
+
+func (hm *headerMatcher) String() string {
+	return fmt.Sprintf("header %s ~ %q", hm.name, hm.regex)
+}
+
+// HostMatcher returns a Matcher which matches requests whose host, including the port if present, matches the regex.
+// It panics if the regex is invalid, so patterns not known in advance should be built with NewMatcher or CompileMatcher.
+func HostMatcher(host string) Matcher {
+	return &hostMatcher{regex: regexp.MustCompile(host)}
+}
+
+type hostMatcher struct {
+	regex *regexp.Regexp
+}
+
+func (hm *hostMatcher) Match(r *http.Request) bool {
+	return hm.regex.MatchString(r.Host)
+}
+
+func (hm *hostMatcher) String() string {
+	return fmt.Sprintf("host ~ %q", hm.regex)
+}
+
+// PathMatcher returns a Matcher which matches requests whose path matches the regex
+func PathMatcher(pathRegex string) (Matcher, error) {
+	regex, err := regexp.Compile(pathRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathMatcher{regex: regex, pattern: fmt.Sprintf("path ~ %q", pathRegex)}, nil
+}
+
+// PathGlobMatcher returns a Matcher which matches requests whose whole path matches the glob.
+// In globs, * matches any sequence of characters but /, ** matches any sequence including /, ? matches a single
+// character but / and [...] matches a character class, negated if it starts with ! or ^.
+// For instance, /static/**.js matches any JavaScript file under /static.
+func PathGlobMatcher(glob string) (Matcher, error) {
+	pattern := &strings.Builder{}
+	pattern.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				pattern.WriteString(".*")
+				i++
+			} else {
+				pattern.WriteString("[^/]*")
+			}
+		case '?':
+			pattern.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in glob %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
 			}
+			pattern.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
 		}
+	}
+	pattern.WriteString("$")
+
+	regex, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+
+	return &pathMatcher{regex: regex, pattern: fmt.Sprintf("path glob %q", glob)}, nil
+}
+
+type pathMatcher struct {
+	regex   *regexp.Regexp
+	pattern string
+}
+
+func (pm *pathMatcher) Match(r *http.Request) bool {
+	return pm.regex.MatchString(r.URL.Path)
+}
+
+func (pm *pathMatcher) String() string {
+	return pm.pattern
+}
+
+// MethodMatcher returns a Matcher which matches requests using any of the given methods, case-insensitively
+func MethodMatcher(methods ...string) (Matcher, error) {
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("at least one method is required")
+	}
+
+	mm := methodMatcher{}
+	for _, method := range methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		mm = append(mm, strings.ToUpper(method))
+	}
+
+	return mm, nil
+}
+
+type methodMatcher []string
+
+func (mm methodMatcher) Match(r *http.Request) bool {
+	for _, method := range mm {
+		if strings.EqualFold(r.Method, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (mm methodMatcher) String() string {
+	return "method " + strings.Join(mm, "|")
+}
+
+// QueryMatcher returns a Matcher which matches requests with a query parameter named name, any of whose values matches
+// valueRegex. An empty valueRegex matches any value, so only the presence of the parameter is checked.
+func QueryMatcher(name, valueRegex string) (Matcher, error) {
+	regex, err := regexp.Compile(valueRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryMatcher{name: name, regex: regex}, nil
+}
+
+type queryMatcher struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+func (qm *queryMatcher) Match(r *http.Request) bool {
+	return anyMatches(qm.regex, r.URL.Query()[qm.name])
+}
 
+func (qm *queryMatcher) String() string {
+	return fmt.Sprintf("query %s ~ %q", qm.name, qm.regex)
+}
+
+// CookieMatcher returns a Matcher which matches requests carrying a cookie named name whose value matches valueRegex.
+// An empty valueRegex matches any value, so only the presence of the cookie is checked.
+func CookieMatcher(name, valueRegex string) (Matcher, error) {
+	regex, err := regexp.Compile(valueRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cookieMatcher{name: name, regex: regex}, nil
+}
+
+type cookieMatcher struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+func (cm *cookieMatcher) Match(r *http.Request) bool {
+	return anyMatches(cm.regex, cookieValues(r, cm.name))
+}
+
+func (cm *cookieMatcher) String() string {
+	return fmt.Sprintf("cookie %s ~ %q", cm.name, cm.regex)
+}
+
+// cookieValues returns the values of every cookie named name sent with the request
+func cookieValues(r *http.Request, name string) []string {
+	var values []string
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == name {
+			values = append(values, cookie.Value)
+		}
+	}
+
+	return values
+}
+
+func anyMatches(regex *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if regex.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CIDRMatcher returns a Matcher which matches requests coming from a client whose IP address is in any of the given
+// networks, such as 10.0.0.0/8 or fd00::/8. Single addresses are accepted as well.
+// The address of the connection is used, as headers such as X-Forwarded-For can be forged by clients.
+func CIDRMatcher(cidrs ...string) (Matcher, error) {
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("at least one network is required")
+	}
+
+	cm := &cidrMatcher{cidrs: cidrs}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			cm.networks = append(cm.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		cm.networks = append(cm.networks, network)
+	}
+
+	return cm, nil
+}
+
+type cidrMatcher struct {
+	networks []*net.IPNet
+	cidrs    []string
+}
+
+func (cm *cidrMatcher) Match(r *http.Request) bool {
+	ip := clientIP(r)
+	if ip == nil {
 		return false
-	})
+	}
+
+	for _, network := range cm.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func HostMatcher(host string) Matcher {
-	// TODO: Proper error log
-	regex := regexp.MustCompile(host)
-	return MatcherFunc(func(r *http.Request) bool {
-		return regex.MatchString(r.Host)
-	})
+func (cm *cidrMatcher) String() string {
+	return "client in " + strings.Join(cm.cidrs, ", ")
+}
+
+// clientIP returns the IP address of the client which sent the request, or nil if it cannot be known
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// SchemeMatcher returns a Matcher which matches requests for URLs with the given scheme, either http or https.
+// Requests received over TLS, such as the ones intercepted from CONNECT tunnels, are considered to be https.
+func SchemeMatcher(scheme string) (Matcher, error) {
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unknown scheme %q", scheme)
+	}
+
+	return schemeMatcher(scheme), nil
+}
+
+type schemeMatcher string
+
+func (sm schemeMatcher) Match(r *http.Request) bool {
+	return requestScheme(r) == string(sm)
+}
+
+func (sm schemeMatcher) String() string {
+	return "scheme " + string(sm)
+}
+
+func requestScheme(r *http.Request) string {
+	switch {
+	case r.TLS != nil:
+		return "https"
+	case r.URL.Scheme != "":
+		return strings.ToLower(r.URL.Scheme)
+	}
+
+	return "http"
+}
+
+// ContentTypeMatcher returns a Matcher which matches requests whose body has any of the given media types, such as
+// application/json. Parameters, such as charset, are ignored, and wildcards such as text/* are allowed.
+func ContentTypeMatcher(mediaTypes ...string) (Matcher, error) {
+	if len(mediaTypes) == 0 {
+		return nil, fmt.Errorf("at least one media type is required")
+	}
+
+	ctm := contentTypeMatcher{}
+	for _, mediaType := range mediaTypes {
+		parsed, _, err := mime.ParseMediaType(mediaType)
+		if err != nil || !strings.Contains(parsed, "/") {
+			return nil, fmt.Errorf("invalid media type %q", mediaType)
+		}
+		ctm = append(ctm, parsed)
+	}
+
+	return ctm, nil
+}
+
+type contentTypeMatcher []string
+
+func (ctm contentTypeMatcher) Match(r *http.Request) bool {
+	return ctm.matches(requestMediaType(r))
+}
+
+// matches returns true if mediaType, which must be already parsed, is any of the media types of the matcher
+func (ctm contentTypeMatcher) matches(mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+
+	for _, wanted := range ctm {
+		if wanted == mediaType || wanted == "*/*" ||
+			strings.HasSuffix(wanted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(wanted, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ctm contentTypeMatcher) String() string {
+	return "content type " + strings.Join(ctm, ", ")
+}
+
+// requestMediaType returns the media type of the request body, lowercased and without parameters
+func requestMediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// BodySizeMatcher returns a Matcher which matches requests whose body is between min and max bytes long, both
+// included. A negative max sets no upper limit. The size is taken from Content-Length, so requests whose body length
+// is not known in advance, such as chunked ones, never match.
+func BodySizeMatcher(min, max int64) (Matcher, error) {
+	if min < 0 || max >= 0 && min > max {
+		return nil, fmt.Errorf("invalid body size range [%d, %d]", min, max)
+	}
+
+	return &bodySizeMatcher{min: min, max: max}, nil
+}
+
+type bodySizeMatcher struct {
+	min, max int64
+}
+
+func (bm *bodySizeMatcher) Match(r *http.Request) bool {
+	size := r.ContentLength
+	if r.Body == nil || r.Body == http.NoBody {
+		size = 0
+	}
+
+	return bm.matches(size)
+}
+
+// matches returns true if size is within the range of the matcher. Negative sizes are unknown, and never match.
+func (bm *bodySizeMatcher) matches(size int64) bool {
+	return size >= 0 && size >= bm.min && (bm.max < 0 || size <= bm.max)
+}
+
+func (bm *bodySizeMatcher) String() string {
+	if bm.max < 0 {
+		return fmt.Sprintf("body size >= %d", bm.min)
+	}
+
+	return fmt.Sprintf("body size in [%d, %d]", bm.min, bm.max)
+}
+
+// And returns a Matcher which matches requests matched by all of the supplied matchers. Matchers are evaluated in
+// order, and evaluation stops at the first one which does not match. And with no matchers matches anything.
+func And(matchers ...Matcher) Matcher {
+	return andMatcher(matchers)
+}
+
+type andMatcher []Matcher
+
+func (am andMatcher) Match(r *http.Request) bool {
+	for _, m := range am {
+		if !m.Match(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (am andMatcher) String() string {
+	return joinMatchers(am, " && ")
+}
+
+// Or returns a Matcher which matches requests matched by any of the supplied matchers, the same way matchers added to
+// a node do. Matchers are evaluated in order, and evaluation stops at the first matching one. Or with no matchers
+// matches nothing.
+func Or(matchers ...Matcher) Matcher {
+	return orMatcher(matchers)
+}
+
+type orMatcher []Matcher
+
+func (om orMatcher) Match(r *http.Request) bool {
+	for _, m := range om {
+		if m.Match(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (om orMatcher) String() string {
+	return joinMatchers(om, " || ")
+}
+
+// Not returns a Matcher which matches requests not matched by matcher
+func Not(matcher Matcher) Matcher {
+	return notMatcher{matcher}
+}
+
+type notMatcher struct {
+	matcher Matcher
+}
+
+func (nm notMatcher) Match(r *http.Request) bool {
+	return !nm.matcher.Match(r)
+}
+
+func (nm notMatcher) String() string {
+	return "!" + describe(nm.matcher)
+}
+
+func joinMatchers(matchers []Matcher, operator string) string {
+	descriptions := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		descriptions = append(descriptions, describe(m))
+	}
+
+	return "(" + strings.Join(descriptions, operator) + ")"
 }
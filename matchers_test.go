@@ -2,8 +2,11 @@ package goxxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"roob.re/goxxy/tests"
+	"strings"
 	"testing"
 )
 
@@ -33,6 +36,29 @@ func TestHeaderMatcher(t *testing.T) {
 	}
 }
 
+func TestHeaderMatcherValues(t *testing.T) {
+	req := tests.Get()
+	req.Header.Add("Accept-Language", "es")
+	req.Header.Add("Accept-Language", "en")
+	req.Header["x-lowercase"] = []string{"set directly"}
+
+	if !HeaderMatcher("Accept-Language", "^en$").Match(req) {
+		t.Error("Second value of Accept-Language did not match")
+	}
+
+	if !HeaderMatcher("accept-language", "^es$").Match(req) {
+		t.Error("Lowercase header name did not match")
+	}
+
+	if !HeaderMatcher("X-Lowercase", "directly").Match(req) {
+		t.Error("Header stored under a non-canonical key did not match")
+	}
+
+	if HeaderMatcher("Accept-Language", "^fr$").Match(req) {
+		t.Error("Match for value not present in any of the values")
+	}
+}
+
 func TestHostMatcher(t *testing.T) {
 	req := tests.Get()
 
@@ -59,3 +85,155 @@ func TestHostMatcher(t *testing.T) {
 		t.Error("Did not match with custom port not included in regex")
 	}
 }
+
+func TestCombinators(t *testing.T) {
+	req := tests.Get()
+	req.Header.Set("X-Custom", "customvalue")
+
+	host := HostMatcher("example.org")
+	header := HeaderMatcher("X-Custom", "nope")
+
+	for _, tc := range []struct {
+		matcher  Matcher
+		expected bool
+	}{
+		{And(host, Not(header)), true},
+		{And(host, header), false},
+		{Or(header, host), true},
+		{Or(header, Not(host)), false},
+		{And(), true},
+		{Or(), false},
+	} {
+		if tc.matcher.Match(req) != tc.expected {
+			t.Errorf("%s: expected %t", describe(tc.matcher), tc.expected)
+		}
+	}
+
+	if description := describe(And(host, Not(header))); description != `(host ~ "example.org" && !header X-Custom ~ "nope")` {
+		t.Errorf("Unexpected description %s", description)
+	}
+}
+
+func TestRequestMatchers(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://example.org/static/js/app.min.js?debug=1&lang=en&lang=es", strings.NewReader("a=1"))
+	req.RemoteAddr = "10.1.2.3:51234"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abcd"})
+
+	must := func(m Matcher, err error) Matcher {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	for _, tc := range []struct {
+		matcher  Matcher
+		expected bool
+	}{
+		{must(PathMatcher(`\.js$`)), true},
+		{must(PathMatcher(`^/api/`)), false},
+		{must(PathGlobMatcher("/static/**.js")), true},
+		{must(PathGlobMatcher("/static/*.js")), false},
+		{must(PathGlobMatcher("/static/j?/app.*.js")), true},
+		{must(PathGlobMatcher("/static/[!a-z]s/*")), false},
+		{must(PathGlobMatcher("/static/[a-z]s/*")), true},
+		{must(MethodMatcher("get", "post")), true},
+		{must(MethodMatcher("PUT")), false},
+		{must(QueryMatcher("lang", "^es$")), true},
+		{must(QueryMatcher("debug", "")), true},
+		{must(QueryMatcher("missing", "")), false},
+		{must(CookieMatcher("session", "^ab")), true},
+		{must(CookieMatcher("other", "")), false},
+		{must(CIDRMatcher("192.168.0.0/16", "10.0.0.0/8")), true},
+		{must(CIDRMatcher("10.1.2.4", "fd00::/8")), false},
+		{must(CIDRMatcher("10.1.2.3")), true},
+		{must(SchemeMatcher("http")), true},
+		{must(SchemeMatcher("HTTPS")), false},
+		{must(ContentTypeMatcher("application/x-www-form-urlencoded")), true},
+		{must(ContentTypeMatcher("application/*")), true},
+		{must(ContentTypeMatcher("text/*", "application/json")), false},
+		{must(BodySizeMatcher(1, 3)), true},
+		{must(BodySizeMatcher(4, -1)), false},
+	} {
+		if tc.matcher.Match(req) != tc.expected {
+			t.Errorf("%s: expected %t", describe(tc.matcher), tc.expected)
+		}
+	}
+
+	tlsReq := httptest.NewRequest(http.MethodGet, "https://example.org/", nil)
+	if !must(SchemeMatcher("https")).Match(tlsReq) {
+		t.Error("TLS request did not match https")
+	}
+
+	chunked := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a=1"))
+	chunked.ContentLength = -1
+	if must(BodySizeMatcher(0, -1)).Match(chunked) {
+		t.Error("Request of unknown length matched a body size")
+	}
+
+	if !must(BodySizeMatcher(0, 0)).Match(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("Request without body did not match a size of 0")
+	}
+}
+
+func TestRequestMatchersErrors(t *testing.T) {
+	for name, err := range map[string]error{
+		"path":             second(PathMatcher("(")),
+		"glob":             second(PathGlobMatcher("/static/[abc")),
+		"glob range":       second(PathGlobMatcher("/[z-a]")),
+		"no methods":       second(MethodMatcher()),
+		"method":           second(MethodMatcher("GET /")),
+		"query":            second(QueryMatcher("q", "(")),
+		"cookie":           second(CookieMatcher("session", "(")),
+		"cidr":             second(CIDRMatcher("10.0.0.0/33")),
+		"ip":               second(CIDRMatcher("localhost")),
+		"scheme":           second(SchemeMatcher("ftp")),
+		"content type":     second(ContentTypeMatcher("json")),
+		"body size":        second(BodySizeMatcher(10, 5)),
+		"negative minimum": second(BodySizeMatcher(-1, 5)),
+	} {
+		if err == nil {
+			t.Errorf("%s: no error returned", name)
+		}
+	}
+}
+
+func second(_ Matcher, err error) error {
+	return err
+}
+
+func TestRequestMatcherFactories(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/docs/index.html", nil)
+
+	for _, tc := range []struct {
+		kind, params string
+		expected     bool
+	}{
+		{"path", `{"glob": "/docs/*.html"}`, true},
+		{"path", `{"regex": "^/api"}`, false},
+		{"method", `{"methods": ["GET"]}`, true},
+		{"scheme", `{"scheme": "https"}`, false},
+		{"bodySize", `{"min": 0}`, true},
+		{"bodySize", `{"min": 1}`, false},
+	} {
+		matcher, err := NewMatcher(tc.kind, func(v interface{}) error {
+			return json.Unmarshal([]byte(tc.params), v)
+		})
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.kind, tc.params, err)
+			continue
+		}
+
+		if matcher.Match(req) != tc.expected {
+			t.Errorf("%s %s: expected %t", tc.kind, tc.params, tc.expected)
+		}
+	}
+
+	if _, err := NewMatcher("path", func(v interface{}) error {
+		return json.Unmarshal([]byte(`{"glob": "/*", "regex": "."}`), v)
+	}); err == nil {
+		t.Error("Both glob and regex were accepted")
+	}
+}
@@ -0,0 +1,238 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBuckets are the upper bounds, in seconds, of the buckets used by latency histograms
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects statistics about the exchanges handled by the Goxxy nodes it is assigned to, and serves them in the
+// Prometheus text exposition format. Series are labeled by the path of the matched node (see RequestContext.NodePath)
+// and, where it applies, by module (see ModuleName).
+// Mangle durations measure the time spent in Mangle. Work deferred by streaming manglers until the body is read is not
+// accounted for.
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+
+	requests      *metricFamily
+	upstreamErrs  *metricFamily
+	latency       *metricFamily
+	bytesIn       *metricFamily
+	bytesOut      *metricFamily
+	mangleLatency *metricFamily
+}
+
+type metricFamily struct {
+	name, help, kind string
+	labels           []string
+	series           map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64  // Counters
+	buckets []uint64 // Histograms, cumulative counts are computed when writing
+	sum     float64
+	count   uint64
+}
+
+// NewMetrics returns an empty set of metrics. Assign it to the Metrics field of the nodes to be measured; children
+// created afterwards inherit it.
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.requests = m.family("goxxy_requests_total", "Requests handled, by class of the status code sent to the client. Connections closed without an answer have code none.", "counter", "node", "code")
+	m.upstreamErrs = m.family("goxxy_upstream_errors_total", "Requests which could not be sent upstream.", "counter", "node")
+	m.latency = m.family("goxxy_upstream_latency_seconds", "Time until response headers are received from upstream.", "histogram", "node")
+	m.bytesIn = m.family("goxxy_request_bytes_total", "Request body bytes received from clients.", "counter", "node")
+	m.bytesOut = m.family("goxxy_response_bytes_total", "Response body bytes sent to clients.", "counter", "node")
+	m.mangleLatency = m.family("goxxy_mangle_duration_seconds", "Time spent in each mangler.", "histogram", "node", "module")
+	return m
+}
+
+func (m *Metrics) family(name, help, kind string, labels ...string) *metricFamily {
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	m.families = append(m.families, f)
+	return f
+}
+
+func (m *Metrics) get(f *metricFamily, labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, exists := f.series[key]
+	if !exists {
+		s = &metricSeries{labels: labels}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (m *Metrics) add(f *metricFamily, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(f, labels).value += value
+}
+
+func (m *Metrics) observe(f *metricFamily, d time.Duration, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(f, labels)
+	seconds := d.Seconds()
+	for i, bound := range defaultBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(rw)
+}
+
+// ListenAndServe serves the metrics on /metrics on a separate listener
+func (m *Metrics) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.ListenAndServe(addr, mux)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := &strings.Builder{}
+	for _, f := range m.families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			labels := formatLabels(f.labels, s.labels)
+
+			if f.kind != "histogram" {
+				fmt.Fprintf(b, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+				continue
+			}
+
+			names := append(append([]string{}, f.labels...), "le")
+			values := append(append([]string{}, s.labels...), "")
+
+			var cumulative uint64
+			for i, bound := range defaultBuckets {
+				cumulative += s.buckets[i]
+				values[len(values)-1] = formatFloat(bound)
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, formatLabels(names, values), cumulative)
+			}
+			values[len(values)-1] = "+Inf"
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, formatLabels(names, values), s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels, formatFloat(s.sum))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels, s.count)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], value)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ModuleName returns the name a module is identified by in metrics and logs: the result of its ModuleName method if
+// it has one, or its type name otherwise.
+func ModuleName(module interface{}) string {
+	if named, isNamed := module.(interface{ ModuleName() string }); isNamed {
+		return named.ModuleName()
+	}
+
+	return strings.TrimPrefix(fmt.Sprintf("%T", module), "*")
+}
+
+// metricsNode returns the node label for an exchange
+func metricsNode(rc *RequestContext) string {
+	if rc != nil && len(rc.Path) > 0 {
+		return rc.NodePath()
+	}
+
+	return "unmatched"
+}
+
+// observeRequest records a finished exchange. Nil Metrics are valid and record nothing, so nodes without metrics do
+// not need to check.
+func (m *Metrics) observeRequest(rc *RequestContext) {
+	if m == nil {
+		return
+	}
+
+	node := metricsNode(rc)
+	code := "none"
+	if rc.Status != 0 {
+		code = strconv.Itoa(rc.Status/100) + "xx"
+	}
+
+	m.add(m.requests, 1, node, code)
+	m.add(m.bytesIn, float64(atomic.LoadInt64(&rc.BytesIn)), node)
+	m.add(m.bytesOut, float64(rc.BytesOut), node)
+}
+
+// observeUpstream records the latency of a request sent upstream, or its failure
+func (m *Metrics) observeUpstream(rc *RequestContext, err error) {
+	if m == nil || rc == nil {
+		return
+	}
+
+	if err != nil {
+		m.add(m.upstreamErrs, 1, metricsNode(rc))
+		return
+	}
+
+	m.observe(m.latency, rc.UpstreamLatency(), metricsNode(rc))
+}
+
+// observeMangler records the time a mangler took to process a response for r
+func (m *Metrics) observeMangler(r *http.Request, mangler Mangler, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.observe(m.mangleLatency, time.Since(start), metricsNode(FromRequest(r)), ModuleName(mangler))
+}
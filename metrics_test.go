@@ -0,0 +1,68 @@
+package goxxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type namedMangler struct{}
+
+func (namedMangler) Mangle(response *http.Response) *http.Response { return response }
+func (namedMangler) ModuleName() string                            { return "named" }
+
+func TestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(rw, r)
+			return
+		}
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	g := New()
+	g.Metrics = NewMetrics()
+	g.MatchFunc(func(r *http.Request) bool { return r.Host != "unmatched.test" })
+	api := g.Child()
+	api.Name = "api"
+	api.MatchFunc(func(r *http.Request) bool { return true })
+	api.AddMangler(namedMangler{})
+	api.AddManglerFunc(func(response *http.Response) *http.Response { return response })
+
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, upstream.URL+"/", strings.NewReader("body")))
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, upstream.URL+"/missing", nil))
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil))
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://unmatched.test/", nil))
+
+	rec := httptest.NewRecorder()
+	g.Metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposition := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE goxxy_requests_total counter",
+		`goxxy_requests_total{node="root/api",code="2xx"} 1`,
+		`goxxy_requests_total{node="root/api",code="4xx"} 1`,
+		`goxxy_requests_total{node="root/api",code="5xx"} 1`,
+		`goxxy_requests_total{node="unmatched",code="5xx"} 1`,
+		`goxxy_upstream_errors_total{node="root/api"} 1`,
+		`goxxy_upstream_latency_seconds_count{node="root/api"} 2`,
+		`goxxy_upstream_latency_seconds_bucket{node="root/api",le="+Inf"} 2`,
+		`goxxy_request_bytes_total{node="root/api"} 4`,
+		`goxxy_response_bytes_total{node="root/api"} 24`,
+		`goxxy_mangle_duration_seconds_count{node="root/api",module="named"} 2`,
+		`goxxy_mangle_duration_seconds_count{node="root/api",module="goxxy.ManglerFunc"} 2`,
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("Line %q not found in:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	labels := formatLabels([]string{"a", "b"}, []string{`quo"te`, "back\\slash\nnewline"})
+	if labels != `{a="quo\"te",b="back\\slash\nnewline"}` {
+		t.Errorf("Labels not escaped properly: %s", labels)
+	}
+}
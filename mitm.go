@@ -0,0 +1,431 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"bufio"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const leafValidity = 365 * 24 * time.Hour
+
+// maxCachedLeafs is the number of leaf certificates a CertAuthority keeps cached
+const maxCachedLeafs = 1024
+
+// interceptIdleTimeout is the time intercepted connections are kept open waiting for a new request, unless the Server
+// accepting them sets its own IdleTimeout
+const interceptIdleTimeout = 90 * time.Second
+
+// CertAuthority signs leaf certificates on the fly, which Goxxy presents to clients when intercepting CONNECT requests.
+// Clients must trust the CA certificate for the interception to be transparent.
+type CertAuthority struct {
+	cert    *x509.Certificate
+	certDER []byte
+	key     crypto.Signer
+	leafKey *ecdsa.PrivateKey // A single key is shared by all leafs, as generating one per host is expensive
+
+	mu      sync.Mutex
+	cache   map[string]*list.Element // Values are *cachedLeaf, kept in lru
+	lru     *list.List               // Most recently used first
+	pending map[string]*pendingLeaf
+}
+
+// cachedLeaf is an entry of the CertAuthority cache
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// pendingLeaf is a certificate being signed, which concurrent calls to Sign for the same host wait for
+type pendingLeaf struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// NewCertAuthority returns a CertAuthority which will sign leaf certificates using the supplied CA certificate and key.
+func NewCertAuthority(ca tls.Certificate) (*CertAuthority, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("CA certificate chain is empty")
+	}
+
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, errors.New("supplied certificate is not a CA")
+	}
+
+	key, isSigner := ca.PrivateKey.(crypto.Signer)
+	if !isSigner {
+		return nil, errors.New("CA private key cannot be used for signing")
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertAuthority{
+		cert:    cert,
+		certDER: ca.Certificate[0],
+		key:     key,
+		leafKey: leafKey,
+		cache:   make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]*pendingLeaf),
+	}, nil
+}
+
+// LoadCertAuthority reads a PEM-encoded CA certificate and key from disk and returns a CertAuthority using them.
+func LoadCertAuthority(certFile, keyFile string) (*CertAuthority, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCertAuthority(ca)
+}
+
+// GenerateCertAuthority creates a new self-signed CA with the given common name, valid for ten years.
+func GenerateCertAuthority(commonName string) (*CertAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Goxxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCertAuthority(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+}
+
+// Certificate returns the CA certificate, so it can be exported and installed on clients.
+func (ca *CertAuthority) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// Sign returns a leaf certificate for host signed by the CA. host must be a valid hostname or IP address.
+// Certificates are cached, so subsequent calls for the same host are cheap. Up to maxCachedLeafs are kept, evicting the
+// least recently used ones, and concurrent calls for a host not in the cache wait for a single certificate to be signed.
+func (ca *CertAuthority) Sign(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !validLeafHost(host) {
+		return nil, fmt.Errorf("cannot sign a certificate for invalid hostname %q", host)
+	}
+
+	ca.mu.Lock()
+	if cert := ca.cached(host); cert != nil {
+		ca.mu.Unlock()
+		return cert, nil
+	}
+
+	if pending, signing := ca.pending[host]; signing {
+		ca.mu.Unlock()
+		<-pending.done
+		return pending.cert, pending.err
+	}
+
+	pending := &pendingLeaf{done: make(chan struct{})}
+	ca.pending[host] = pending
+	ca.mu.Unlock()
+
+	pending.cert, pending.err = ca.sign(host)
+
+	ca.mu.Lock()
+	delete(ca.pending, host)
+	if pending.err == nil {
+		ca.store(host, pending.cert)
+	}
+	ca.mu.Unlock()
+	close(pending.done)
+
+	return pending.cert, pending.err
+}
+
+// cached returns the unexpired certificate cached for host, if any, marking it as the most recently used.
+// ca.mu must be held.
+func (ca *CertAuthority) cached(host string) *tls.Certificate {
+	element, cached := ca.cache[host]
+	if !cached {
+		return nil
+	}
+
+	leaf := element.Value.(*cachedLeaf)
+	if !time.Now().Before(leaf.cert.Leaf.NotAfter) {
+		ca.lru.Remove(element)
+		delete(ca.cache, host)
+		return nil
+	}
+
+	ca.lru.MoveToFront(element)
+	return leaf.cert
+}
+
+// store caches cert for host, evicting the least recently used certificate if the cache is full. ca.mu must be held.
+func (ca *CertAuthority) store(host string, cert *tls.Certificate) {
+	if ca.lru.Len() >= maxCachedLeafs {
+		oldest := ca.lru.Back()
+		ca.lru.Remove(oldest)
+		delete(ca.cache, oldest.Value.(*cachedLeaf).host)
+	}
+
+	ca.cache[host] = ca.lru.PushFront(&cachedLeaf{host: host, cert: cert})
+}
+
+// sign issues a new leaf certificate for host
+func (ca *CertAuthority) sign(host string) (*tls.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.certDER},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// validLeafHost returns whether host is an IP address or a hostname made of valid DNS labels, as clients can send
+// anything as SNI
+func validLeafHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// serveConnect handles a CONNECT request. If a CertAuthority is set, the connection is intercepted and the requests
+// inside it are fed back to g.ServeHTTP. Otherwise, a blind tunnel to the requested host is established.
+func (g *Goxxy) serveConnect(rw http.ResponseWriter, r *http.Request) {
+	hijacker, isHijacker := rw.(http.Hijacker)
+	if !isHijacker {
+		http.Error(rw, "CONNECT not supported by this server", http.StatusNotImplemented)
+		return
+	}
+
+	var upstream net.Conn
+	if g.CA == nil {
+		var err error
+		_, transport, _ := g.upstreamSettings()
+		upstream, err = transport.dial(r.Host)
+		if err != nil {
+			log.Printf("error connecting to %s: %v", r.Host, err)
+			http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("error hijacking CONNECT request: %v", err)
+		return
+	}
+
+	clientConn := &bufferedConn{Conn: conn, reader: buffered.Reader}
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	if upstream != nil {
+		tunnel(clientConn, upstream)
+		return
+	}
+
+	g.intercept(clientConn, r.Host)
+}
+
+// intercept serves the requests sent through an already-accepted CONNECT tunnel to authority.
+// TLS is terminated with a certificate issued by g.CA if the client starts a handshake, otherwise plain HTTP is assumed.
+func (g *Goxxy) intercept(conn *bufferedConn, authority string) {
+	host, _, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = authority
+	}
+
+	var served net.Conn = conn
+	if first, err := conn.reader.Peek(1); err == nil && first[0] == 0x16 { // TLS handshake record
+		served = tls.Server(conn, &tls.Config{
+			NextProtos: []string{"http/1.1"},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName != "" {
+					return g.CA.Sign(hello.ServerName)
+				}
+				return g.CA.Sign(host)
+			},
+		})
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Host == "" {
+				r.Host = authority
+			}
+			g.ServeHTTP(rw, r)
+		}),
+		ErrorLog:    log.New(ioutil.Discard, "", 0),
+		IdleTimeout: interceptIdleTimeout,
+	}
+
+	// Connections accepted by a Server are shut down along with it
+	if tracked, isTracked := conn.Conn.(*trackedConn); isTracked {
+		tracked.server.serveInner(tracked, server)
+	}
+
+	// The server may have been shut down before accepting the connection, which is then closed right away
+	listener := &oneConnListener{conn: served}
+	server.Serve(listener)
+	if !listener.accepted() {
+		served.Close()
+	}
+}
+
+// tunnel copies data between both connections until either of them is closed.
+func tunnel(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, src)
+		dst.Close()
+		done <- struct{}{}
+	}
+
+	go pipe(a, b)
+	go pipe(b, a)
+
+	<-done
+	<-done
+}
+
+// bufferedConn is a net.Conn which reads from a bufio.Reader, so data buffered before hijacking is not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
+
+// oneConnListener is a net.Listener which returns a single connection and then fails.
+// http.Server keeps serving accepted connections after Serve returns, so it can be used to serve a hijacked connection.
+type oneConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done int32
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+		atomic.StoreInt32(&l.done, 1)
+	})
+
+	if conn == nil {
+		return nil, io.EOF
+	}
+
+	return conn, nil
+}
+
+// accepted returns true if the connection was returned by Accept
+func (l *oneConnListener) accepted() bool {
+	return atomic.LoadInt32(&l.done) == 1
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
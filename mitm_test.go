@@ -0,0 +1,112 @@
+package goxxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCertAuthoritySign(t *testing.T) {
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+
+	for _, host := range []string{"www.example.org", "127.0.0.1"} {
+		cert, err := ca.Sign(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Errorf("Leaf for %s does not verify: %v", host, err)
+		}
+
+		cached, _ := ca.Sign(host)
+		if cached != cert {
+			t.Errorf("Leaf for %s was not cached", host)
+		}
+	}
+}
+
+func TestNewCertAuthorityRejectsLeafs(t *testing.T) {
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _ := ca.Sign("www.example.org")
+	if _, err := NewCertAuthority(*leaf); err == nil {
+		t.Error("Leaf certificate accepted as CA")
+	}
+
+	if _, err := NewCertAuthority(tls.Certificate{}); err == nil {
+		t.Error("Empty certificate accepted as CA")
+	}
+}
+
+func TestCertAuthoritySignInvalidHost(t *testing.T) {
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"", "exa mple.org", "-example.org", "example..org", "example.org/path", strings.Repeat("a", 64) + ".org"} {
+		if _, err := ca.Sign(host); err == nil {
+			t.Errorf("Leaf signed for invalid host %q", host)
+		}
+	}
+
+	if _, err := ca.Sign("WWW.Example.org."); err != nil {
+		t.Errorf("Valid host rejected: %v", err)
+	}
+}
+
+func TestCertAuthoritySignConcurrent(t *testing.T) {
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(chan *tls.Certificate, 8)
+	for i := 0; i < cap(certs); i++ {
+		go func() {
+			cert, _ := ca.Sign("www.example.org")
+			certs <- cert
+		}()
+	}
+
+	first := <-certs
+	for i := 1; i < cap(certs); i++ {
+		if cert := <-certs; cert != first {
+			t.Fatal("Concurrent calls signed more than one leaf for the same host")
+		}
+	}
+}
+
+func TestCertAuthorityCacheBounded(t *testing.T) {
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := ca.Sign("host0.example.org")
+	for i := 1; i <= maxCachedLeafs; i++ {
+		if _, err := ca.Sign(fmt.Sprintf("host%d.example.org", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(ca.cache) != maxCachedLeafs || ca.lru.Len() != maxCachedLeafs {
+		t.Errorf("Cache holds %d leafs, expected %d", len(ca.cache), maxCachedLeafs)
+	}
+
+	if cert, _ := ca.Sign("host0.example.org"); cert == first {
+		t.Error("Least recently used leaf was not evicted")
+	}
+}
@@ -0,0 +1,170 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"roob.re/goxxy"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines written by AccessLog
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined is the Combined Log Format used by Apache and nginx, followed by the node handling the
+	// request, the upstream latency in milliseconds and the manglers which changed the response:
+	// 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET http://example.org/ HTTP/1.1" 200 2326 "-" "curl/7.64.1" node="root/api" upstream_ms=12.345 changed="modules.RegexMangler"
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per line, with the fields of AccessLogEntry
+	AccessLogJSON
+)
+
+// AccessLogEntry is the information AccessLog writes about each exchange
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientAddr string    `json:"clientAddr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"` // 0 if the connection was closed without an answer
+	Size       int64     `json:"size"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	UpstreamMs float64   `json:"upstreamMs"` // Time until the response headers were received from upstream
+	DurationMs float64   `json:"durationMs"` // Time until the exchange finished
+	Node       string    `json:"node"`       // Path of the node which handled the request, empty if nothing matched
+	ChangedBy  []string  `json:"changedBy"`  // Manglers which changed the response
+}
+
+// AccessLog writes a line to Output for each exchange, in the chosen Format.
+// As a Middleware, it logs the exchanges handled by the node it is added to. To log every exchange in a tree, set its
+// Log method as the ExchangeHook of the root instead.
+// Output can be any writer, such as a RotatingFile. Lines are written with a single call to Write.
+type AccessLog struct {
+	Output io.Writer
+	Format AccessLogFormat
+
+	mu sync.Mutex
+}
+
+// Middleware logs the exchange once the response has been sent
+func (al *AccessLog) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rc := goxxy.FromRequest(r)
+		if rc == nil {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		rc.TrackChanges = true
+		handler.ServeHTTP(rw, r)
+		al.Log(rc)
+	})
+}
+
+// Log writes the line for a finished exchange. Errors writing to Output are ignored.
+func (al *AccessLog) Log(rc *goxxy.RequestContext) {
+	if al.Output == nil {
+		return
+	}
+
+	line := al.format(NewAccessLogEntry(rc))
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.Output.Write(line)
+}
+
+// Flush writes out the data buffered by Output, if it is a buffered writer such as bufio.Writer
+func (al *AccessLog) Flush() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if flusher, isFlusher := al.Output.(interface{ Flush() error }); isFlusher {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+// NewAccessLogEntry gathers the information about an exchange from its RequestContext
+func NewAccessLogEntry(rc *goxxy.RequestContext) *AccessLogEntry {
+	r := rc.Request
+
+	entry := &AccessLogEntry{
+		Time:       rc.Start,
+		ClientAddr: ByClientIP(r),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Proto:      r.Proto,
+		Status:     rc.Status,
+		Size:       rc.BytesOut,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		UpstreamMs: milliseconds(rc.UpstreamLatency()),
+		DurationMs: milliseconds(time.Since(rc.Start)),
+		Node:       rc.NodePath(),
+		ChangedBy:  append([]string{}, rc.Changed...),
+	}
+
+	// Requests received as an origin server, e.g. intercepted ones, only carry the path
+	if !r.URL.IsAbs() {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		entry.URL = scheme + "://" + r.Host + r.URL.RequestURI()
+	}
+
+	if user, _, hasAuth := r.BasicAuth(); hasAuth {
+		entry.User = user
+	}
+
+	return entry
+}
+
+func (al *AccessLog) format(entry *AccessLogEntry) []byte {
+	if al.Format == AccessLogJSON {
+		line, _ := json.Marshal(entry)
+		return append(line, '\n')
+	}
+
+	size := "-"
+	if entry.Size > 0 {
+		size = strconv.FormatInt(entry.Size, 10)
+	}
+
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" node=\"%s\" upstream_ms=%.3f changed=\"%s\"\n",
+		entry.ClientAddr,
+		escapeLogField(orDash(entry.User)),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, escapeLogField(entry.URL), entry.Proto,
+		entry.Status,
+		size,
+		escapeLogField(orDash(entry.Referer)),
+		escapeLogField(orDash(entry.UserAgent)),
+		escapeLogField(entry.Node),
+		entry.UpstreamMs,
+		strings.Join(entry.ChangedBy, ","),
+	))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeLogField escapes quotes and control characters, so client-supplied values cannot forge log lines
+func escapeLogField(s string) string {
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
@@ -0,0 +1,79 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"roob.re/goxxy"
+	"strings"
+	"testing"
+)
+
+func accessLogProxy(t *testing.T, al *AccessLog) (*goxxy.Goxxy, *httptest.Server) {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Server", "nginx")
+		rw.Write([]byte("hello"))
+	}))
+
+	g := goxxy.New()
+	api := g.Child()
+	api.Name = "api"
+	api.MatchFunc(func(r *http.Request) bool { return true })
+	api.AddMiddleware(al)
+	api.AddMangler((&RegexMangler{}).AddHeaderRegex("Server", "nginx", "goxxy"))
+	api.AddManglerFunc(func(response *http.Response) *http.Response { return response })
+
+	return g, upstream
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	out := &bytes.Buffer{}
+	g, upstream := accessLogProxy(t, &AccessLog{Output: out})
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/path?q=1", nil)
+	req.Header.Set("User-Agent", `evil" agent`)
+	g.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := out.String()
+	expected := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET http://127\.0\.0\.1:\d+/path\?q=1 HTTP/1\.1" 200 5 "-" "evil\\" agent" node="root/api" upstream_ms=\d+\.\d{3} changed="modules\.RegexMangler"\n$`)
+	if !expected.MatchString(line) {
+		t.Errorf("Unexpected line %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	out := &bytes.Buffer{}
+	al := &AccessLog{Output: out, Format: AccessLogJSON}
+
+	// Log every exchange in the tree through the hook, which children inherit
+	g := goxxy.New()
+	g.ExchangeHook = al.Log
+	child := g.Child()
+	child.Name = "child"
+	child.AddManglerFunc(func(response *http.Response) *http.Response {
+		response.StatusCode = http.StatusAccepted
+		return response
+	})
+
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, upstream.URL, strings.NewReader("body")))
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON line %q: %v", out.String(), err)
+	}
+
+	if entry.Method != http.MethodPost || entry.Status != http.StatusAccepted || entry.Size != 5 || entry.Node != "root/child" ||
+		entry.URL != upstream.URL || entry.ClientAddr != "192.0.2.1" || len(entry.ChangedBy) != 1 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+}
@@ -60,8 +60,7 @@ func (d *FormDumper) Mangle(response *http.Response) *http.Response {
 		}
 
 		if d.TryhardJson || strings.Contains(response.Header.Get("content-type"), "json") {
-			if response.ContentLength <= d.maxSize() {
-				buffer := CopyBody(response)
+			if buffer, err := BufferBody(response, d.maxSize()); err == nil {
 				json.Unmarshal(buffer, &keys)
 			}
 		}
@@ -80,6 +79,15 @@ func (d *FormDumper) Mangle(response *http.Response) *http.Response {
 	return response
 }
 
+// Flush writes out the data buffered by Output, if it is a buffered writer such as bufio.Writer
+func (d *FormDumper) Flush() error {
+	if flusher, isFlusher := d.Output.(interface{ Flush() error }); isFlusher {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
 func shouldDump(ks *keywordSet, keywords map[string]interface{}) bool {
 	if len(keywords) < 1 {
 		return false
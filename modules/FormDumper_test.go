@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"bufio"
 	"bytes"
 	"net/http"
 	"roob.re/goxxy/tests"
@@ -147,3 +148,24 @@ func TestFormDumperResponseCode(t *testing.T) {
 		t.Error("Should have matched non-OK response due to Ignore flag being true")
 	}
 }
+
+func TestFormDumperFlush(t *testing.T) {
+	out := &bytes.Buffer{}
+	buffered := bufio.NewWriter(out)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/login?user=perry", nil)
+	resp := tests.GetResponse()
+	resp.Request = req
+
+	fd := FormDumper{Output: buffered}
+	fd.Any("user")
+	fd.Mangle(resp)
+
+	if out.Len() != 0 {
+		t.Fatal("Output was not buffered")
+	}
+
+	if err := fd.Flush(); err != nil || out.Len() == 0 {
+		t.Errorf("Output was not flushed: %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"roob.re/goxxy"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultHARMaxBodySize = 1024 * 1024
+	defaultHARMaxEntries  = 1000
+)
+
+// HARRecorder records the exchanges passing through a Goxxy tree as HAR 1.2 entries.
+// As a Middleware, it captures request bodies. As a Mangler, it records the response at its position in the chain, so
+// adding it first records responses as received from upstream, and adding it last records them as sent to the client.
+// Stage can be used to record both versions in the same archive, each entry being tagged with its stage.
+// Entries are kept in memory until Flush writes them to Output, and are then discarded, so each Flush writes an archive
+// with the entries recorded since the previous one. At most MaxEntries are kept, the oldest being dropped first.
+// Flushing several times to the same Output, such as a file opened for appending, leaves one archive after another in
+// it. LoadReplayer reads all of them, while other tools may only read the first one.
+type HARRecorder struct {
+	Output      io.Writer // Flush will write the archive to Output
+	MaxBodySize int64     // Bodies larger than this will be truncated in the archive. Defaults to 1 MiB.
+	MaxEntries  int       // Maximum number of entries kept until the next Flush. Defaults to 1000.
+
+	mu      sync.Mutex
+	entries []HAREntry
+}
+
+// HAR is the root object of an HTTP Archive, as in http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a single exchange. Node and Stage are custom fields holding the node which handled the request and the
+// stage the response was recorded at.
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Node            string      `json:"_node,omitempty"`
+	Stage           string      `json:"_stage,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings are expressed in milliseconds. Blocked holds the time spent in middlewares, and Receive the time spent
+// reading the response body after the response headers arrived.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harRequestBodyKey struct {
+	recorder *HARRecorder
+}
+
+func (h *HARRecorder) maxBodySize() int64 {
+	if h.MaxBodySize != 0 {
+		return h.MaxBodySize
+	}
+	return defaultHARMaxBodySize
+}
+
+func (h *HARRecorder) maxEntries() int {
+	if h.MaxEntries > 0 {
+		return h.MaxEntries
+	}
+	return defaultHARMaxEntries
+}
+
+// add appends entries, dropping the oldest ones if there are more than MaxEntries. h.mu must be held.
+func (h *HARRecorder) add(entries ...HAREntry) {
+	h.entries = append(h.entries, entries...)
+	if excess := len(h.entries) - h.maxEntries(); excess > 0 {
+		h.entries = append(h.entries[:0], h.entries[excess:]...)
+	}
+}
+
+// Middleware captures the body of requests as they are sent upstream, so it can be included in the archive.
+func (h *HARRecorder) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if rc := goxxy.FromRequest(r); rc != nil && r.Body != nil && r.Body != http.NoBody {
+			capture := &bodyCapture{ReadCloser: r.Body, max: h.maxBodySize()}
+			r.Body = capture
+			rc.Set(harRequestBodyKey{h}, capture)
+		}
+
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// Mangle records the response as it is at this point of the chain.
+func (h *HARRecorder) Mangle(response *http.Response) *http.Response {
+	return h.record(response, "")
+}
+
+// Stage returns a Mangler which records responses tagging them with the given stage name, e.g. "pre" or "post".
+func (h *HARRecorder) Stage(stage string) goxxy.Mangler {
+	return goxxy.ManglerFunc(func(response *http.Response) *http.Response {
+		return h.record(response, stage)
+	})
+}
+
+// record wraps the response body so the entry is added once it has been fully read or closed
+func (h *HARRecorder) record(response *http.Response, stage string) *http.Response {
+	entry := HAREntry{StartedDateTime: time.Now(), Stage: stage}
+	var requestBody *bodyCapture
+
+	if rc := goxxy.FromResponse(response); rc != nil {
+		entry.StartedDateTime = rc.Start
+		entry.Node = rc.NodePath()
+		entry.Timings.Wait = milliseconds(rc.UpstreamLatency())
+		if !rc.UpstreamStart.IsZero() {
+			entry.Timings.Blocked = milliseconds(rc.UpstreamStart.Sub(rc.Start))
+		}
+		requestBody, _ = rc.Get(harRequestBodyKey{h}).(*bodyCapture)
+	}
+
+	if response.Request != nil {
+		entry.Request = harRequest(response.Request, requestBody)
+	}
+	entry.Response = harResponse(response)
+
+	responseTime := time.Now()
+	capture := &bodyCapture{ReadCloser: response.Body, max: h.maxBodySize()}
+	capture.done = func() {
+		body, size := capture.snapshot()
+		entry.Response.Content = harContent(response.Header.Get("Content-Type"), body, size)
+		entry.Response.BodySize = size
+		entry.Timings.Receive = milliseconds(time.Since(responseTime))
+		entry.Time = entry.Timings.Blocked + entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+
+		h.mu.Lock()
+		h.add(entry)
+		h.mu.Unlock()
+	}
+
+	if response.Body == nil {
+		capture.finish()
+		return response
+	}
+
+	response.Body = capture
+	return response
+}
+
+// HAR returns the archive recorded since the last Flush
+func (h *HARRecorder) HAR() *HAR {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return newHAR(append([]HAREntry{}, h.entries...))
+}
+
+func newHAR(entries []HAREntry) *HAR {
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "goxxy", Version: "1"},
+		Entries: entries,
+	}}
+}
+
+// WriteTo writes the archive recorded since the last Flush to w as JSON
+func (h *HARRecorder) WriteTo(w io.Writer) (int64, error) {
+	return writeHAR(w, h.HAR())
+}
+
+func writeHAR(w io.Writer, har *HAR) (int64, error) {
+	buf, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(buf, '\n'))
+	return int64(n), err
+}
+
+// Flush writes the archive recorded since the last Flush to Output, if set, and discards its entries.
+// If writing fails, entries are kept for the next Flush.
+func (h *HARRecorder) Flush() error {
+	if h.Output == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	entries := h.entries
+	h.entries = nil
+	h.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if _, err := writeHAR(h.Output, newHAR(entries)); err != nil {
+		h.mu.Lock()
+		recorded := h.entries
+		h.entries = entries
+		h.add(recorded...)
+		h.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// Reset discards all recorded entries
+func (h *HARRecorder) Reset() {
+	h.mu.Lock()
+	h.entries = nil
+	h.mu.Unlock()
+}
+
+func harRequest(r *http.Request, body *bodyCapture) HARRequest {
+	request := HARRequest{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+
+	if request.HTTPVersion == "" {
+		request.HTTPVersion = "HTTP/1.1"
+	}
+
+	for _, cookie := range r.Cookies() {
+		request.Cookies = append(request.Cookies, HARNameValue{cookie.Name, cookie.Value})
+	}
+
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			request.QueryString = append(request.QueryString, HARNameValue{name, value})
+		}
+	}
+
+	if body != nil {
+		data, size := body.snapshot()
+		request.BodySize = size
+		content := harContent(r.Header.Get("Content-Type"), data, size)
+		request.PostData = &HARPostData{MimeType: content.MimeType, Text: content.Text, Comment: content.Comment}
+	}
+
+	return request
+}
+
+func harResponse(response *http.Response) HARResponse {
+	harResponse := HARResponse{
+		Status:      response.StatusCode,
+		StatusText:  http.StatusText(response.StatusCode),
+		HTTPVersion: response.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(response.Header),
+		RedirectURL: response.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	for _, cookie := range response.Cookies() {
+		harResponse.Cookies = append(harResponse.Cookies, HARNameValue{cookie.Name, cookie.Value})
+	}
+
+	return harResponse
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{name, value})
+		}
+	}
+
+	return headers
+}
+
+// harContent builds a HAR content object from a captured body of the given size, encoding it as base64 if it is not
+// valid UTF-8
+func harContent(mimeType string, body []byte, size int64) HARContent {
+	content := HARContent{Size: size, MimeType: mimeType}
+
+	if utf8.Valid(body) {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+
+	if size > int64(len(body)) {
+		content.Comment = "truncated"
+	}
+
+	return content
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// bodyCapture is a ReadCloser which keeps a bounded copy of the data read through it, and calls done once when the
+// underlying body reaches EOF or is closed.
+type bodyCapture struct {
+	io.ReadCloser
+	max  int64
+	done func()
+	once sync.Once
+
+	mu   sync.Mutex // Guards buf and size, as request bodies are still being sent upstream while the entry is built
+	buf  bytes.Buffer
+	size int64
+}
+
+func (bc *bodyCapture) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+
+	bc.mu.Lock()
+	bc.size += int64(n)
+	if remaining := bc.max - int64(bc.buf.Len()); remaining > 0 {
+		if int64(n) < remaining {
+			remaining = int64(n)
+		}
+		bc.buf.Write(p[:remaining])
+	}
+	bc.mu.Unlock()
+
+	if err == io.EOF {
+		bc.finish()
+	}
+
+	return n, err
+}
+
+// snapshot returns a copy of the data captured so far, along with the number of bytes read
+func (bc *bodyCapture) snapshot() ([]byte, int64) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return append([]byte(nil), bc.buf.Bytes()...), bc.size
+}
+
+func (bc *bodyCapture) Close() error {
+	bc.finish()
+	return bc.ReadCloser.Close()
+}
+
+func (bc *bodyCapture) finish() {
+	bc.once.Do(func() {
+		if bc.done != nil {
+			bc.done()
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy"
+	"roob.re/goxxy/tests"
+	"strings"
+	"testing"
+)
+
+func TestHARRecorderStages(t *testing.T) {
+	recorder := &HARRecorder{}
+
+	rm := &RegexMangler{}
+	rm.AddBodyRegex(`example\.org`, "roobre.es")
+
+	response := tests.GetResponse()
+	response = recorder.Stage("pre").Mangle(response)
+	response = rm.Mangle(response)
+	response = recorder.Stage("post").Mangle(response)
+
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	entries := recorder.HAR().Log.Entries
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	for _, entry := range entries {
+		text := entry.Response.Content.Text
+		switch entry.Stage {
+		case "pre":
+			if text != tests.ResponseHTML {
+				t.Error("Pre-mangling body was not recorded verbatim")
+			}
+		case "post":
+			if strings.Contains(text, "example.org") || !strings.Contains(text, "roobre.es") {
+				t.Error("Post-mangling body does not reflect the changes")
+			}
+		default:
+			t.Errorf("Unexpected stage %q", entry.Stage)
+		}
+
+		if entry.Request.URL != tests.RequestURL || entry.Response.Status != http.StatusOK {
+			t.Errorf("Unexpected request or response in entry: %v", entry)
+		}
+	}
+}
+
+func TestHARRecorderTruncates(t *testing.T) {
+	recorder := &HARRecorder{MaxBodySize: 10}
+
+	response := recorder.Mangle(tests.GetResponse())
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != tests.ResponseHTML {
+		t.Error("Recording modified the body")
+	}
+
+	content := recorder.HAR().Log.Entries[0].Response.Content
+	if len(content.Text) != 10 || content.Size != int64(len(tests.ResponseHTML)) || content.Comment != "truncated" {
+		t.Errorf("Body was not truncated properly: %v", content)
+	}
+}
+
+func TestHARRecorderProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(tests.HTMLHandler))
+	defer upstream.Close()
+
+	out := &bytes.Buffer{}
+	recorder := &HARRecorder{Output: out}
+
+	g := goxxy.New()
+	child := g.Child()
+	child.Name = "recorded"
+	child.AddMiddleware(recorder)
+	child.AddMangler(recorder)
+
+	g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, upstream.URL+"/form", strings.NewReader(tests.RequestPostdata)))
+
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	har := HAR{}
+	if err := json.Unmarshal(out.Bytes(), &har); err != nil {
+		t.Fatal(err)
+	}
+
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("Unexpected archive: %s", out.String())
+	}
+
+	entry := har.Log.Entries[0]
+	if entry.Node != "root/recorded" {
+		t.Errorf("Unexpected node %q", entry.Node)
+	}
+
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != tests.RequestPostdata {
+		t.Errorf("Request body was not recorded: %v", entry.Request.PostData)
+	}
+
+	if entry.Response.Content.Text != tests.ResponseHTML {
+		t.Error("Response body was not recorded")
+	}
+}
+
+func TestHARRecorderFlush(t *testing.T) {
+	out := &bytes.Buffer{}
+	recorder := &HARRecorder{Output: out, MaxEntries: 2}
+
+	for i := 0; i < 3; i++ {
+		response := recorder.Mangle(tests.GetResponse())
+		response.Body.Close()
+	}
+
+	if entries := recorder.HAR().Log.Entries; len(entries) != 2 {
+		t.Fatalf("Entries were not bounded: got %d", len(entries))
+	}
+
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	har := HAR{}
+	if err := json.Unmarshal(out.Bytes(), &har); err != nil || len(har.Log.Entries) != 2 {
+		t.Fatalf("Unexpected archive %s: %v", out.String(), err)
+	}
+
+	if entries := recorder.HAR().Log.Entries; len(entries) != 0 {
+		t.Errorf("Flushed entries were not discarded: got %d", len(entries))
+	}
+
+	out.Reset()
+	if err := recorder.Flush(); err != nil || out.Len() != 0 {
+		t.Errorf("Flushing nothing wrote %q: %v", out.String(), err)
+	}
+
+	recorder.Output = failingWriter{}
+	recorder.Mangle(tests.GetResponse()).Body.Close()
+	if err := recorder.Flush(); err == nil {
+		t.Error("Output errors were not returned")
+	}
+	if entries := recorder.HAR().Log.Entries; len(entries) != 1 {
+		t.Errorf("Entries were discarded after a failed flush: got %d", len(entries))
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
@@ -2,10 +2,13 @@ package modules // import "roob.re/goxxy/modules"
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -21,8 +24,10 @@ func (f HTMLModifierFunc) ModifyHTML(doc *goquery.Document) {
 }
 
 // HTMLMangler is a convenience wrapper around goquery, which allows to apply Modifiers to the responses.
+// Request modifiers can be added too, which are applied to HTML documents sent upstream when HTMLMangler is used as a Middleware.
 type HTMLMangler struct {
-	modifiers []HTMLModifier
+	modifiers        []HTMLModifier
+	requestModifiers []HTMLModifier
 	maxSizer
 }
 
@@ -34,33 +39,105 @@ func (h *HTMLMangler) AddModifierFunc(modifier HTMLModifierFunc) {
 	h.modifiers = append(h.modifiers, modifier)
 }
 
+func (h *HTMLMangler) AddRequestModifier(modifier HTMLModifier) {
+	h.requestModifiers = append(h.requestModifiers, modifier)
+}
+
+func (h *HTMLMangler) AddRequestModifierFunc(modifier HTMLModifierFunc) {
+	h.requestModifiers = append(h.requestModifiers, modifier)
+}
+
+// Middleware applies the request modifiers to requests carrying an HTML document, fixing Content-Length afterwards.
+// Requests which cannot be parsed or are larger than MaxSize are sent unmodified.
+func (h *HTMLMangler) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := h.mangleRequest(r); err != nil {
+			log.Printf("%s, request sent unmodified\n", err.Error())
+		}
+
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+func (h *HTMLMangler) mangleRequest(r *http.Request) error {
+	if len(h.requestModifiers) <= 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+
+	body, err := BufferRequestBody(r, h.maxSize())
+	if err == ErrBodyTooLarge || (err == nil && len(body) == 0) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error while reading body: %v", err)
+	}
+
+	newHtml, err := modifyHTML(body, h.requestModifiers)
+	if err != nil {
+		return err
+	}
+
+	SetRequestBody(r, []byte(newHtml))
+	return nil
+}
+
+// Mangle applies the modifiers to the response. If the document cannot be parsed or rendered, the error is logged and
+// the response is sent unmodified.
 func (h *HTMLMangler) Mangle(response *http.Response) *http.Response {
-	if response.ContentLength > h.maxSize() {
+	mangled, err := h.MangleErr(response)
+	if err != nil {
+		log.Printf("%s, response sent unmodified\n", err.Error())
 		return response
 	}
 
+	return mangled
+}
+
+// MangleErr applies the modifiers to the response, returning an error if the document cannot be read, parsed or rendered.
+// Bodies larger than MaxSize are not considered an error, and are sent unmodified.
+func (h *HTMLMangler) MangleErr(response *http.Response) (*http.Response, error) {
 	if len(h.modifiers) <= 0 {
-		return response
+		return response, nil
+	}
+
+	body, err := BufferBody(response, h.maxSize())
+	if err == ErrBodyTooLarge {
+		return response, nil
+	} else if err != nil {
+		return response, fmt.Errorf("error while reading body: %v", err)
+	}
+
+	newHtml, err := modifyHTML(body, h.modifiers)
+	if err != nil {
+		return response, err
 	}
 
-	body := CopyBody(response)
+	response.Body.Close()
+	response.Body = ioutil.NopCloser(strings.NewReader(newHtml))
+	response.ContentLength = int64(len(newHtml))
+	response.Header.Set("Content-Length", strconv.Itoa(len(newHtml)))
+	return response, nil
+}
+
+// modifyHTML parses body, applies the modifiers to it and renders it again
+func modifyHTML(body []byte, modifiers []HTMLModifier) (string, error) {
 	document, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
 	if err != nil {
-		log.Printf("error while building goquery document, response sent unmodified: %s\n", err.Error())
-		return response
+		return "", fmt.Errorf("error while building goquery document: %v", err)
 	}
 
-	for _, modifier := range h.modifiers {
+	for _, modifier := range modifiers {
 		modifier.ModifyHTML(document)
 	}
 
 	newHtml, err := document.Html()
 	if err != nil {
-		log.Printf("error rendering modified HTML, sending response unmodified")
-		return response
+		return "", fmt.Errorf("error rendering modified HTML: %v", err)
 	}
 
-	response.Body.Close()
-	response.Body = ioutil.NopCloser(strings.NewReader(newHtml))
-	return response
+	return newHtml, nil
 }
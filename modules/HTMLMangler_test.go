@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"github.com/PuerkitoBio/goquery"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"roob.re/goxxy/tests"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestHTMLMangler(t *testing.T) {
@@ -70,3 +75,44 @@ func TestHTMLManglerEdgeCases(t *testing.T) {
 		t.Error("Response unmodified despite advertised content length")
 	}
 }
+
+func TestHTMLManglerError(t *testing.T) {
+	htmlMangler := HTMLMangler{}
+	htmlMangler.AddModifierFunc(func(doc *goquery.Document) {})
+
+	response := tests.GetResponse()
+	response.Body = ioutil.NopCloser(iotest.TimeoutReader(strings.NewReader(tests.ResponseHTML)))
+
+	if _, err := htmlMangler.MangleErr(response); err == nil {
+		t.Error("Read error not returned")
+	}
+}
+
+func TestHTMLManglerRequest(t *testing.T) {
+	htmlMangler := HTMLMangler{}
+	htmlMangler.AddRequestModifierFunc(func(doc *goquery.Document) {
+		doc.Find("p").SetText("mangled")
+	})
+
+	for _, tc := range []struct {
+		contentType string
+		mangled     bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/plain", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("<html><body><p>original</p></body></html>"))
+		req.Header.Set("Content-Type", tc.contentType)
+
+		htmlMangler.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(string(body), "mangled") != tc.mangled {
+				t.Errorf("%s: unexpected body %q", tc.contentType, body)
+			}
+
+			if r.ContentLength != int64(len(body)) {
+				t.Errorf("%s: Content-Length not fixed: %d", tc.contentType, r.ContentLength)
+			}
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
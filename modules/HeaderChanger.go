@@ -1,35 +1,294 @@
 package modules // import "roob.re/goxxy/modules"
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // HeaderChanger will add, append, or remove Headers before the request is sent to the server or before the response is sent to the client.
-// HeaderChanger is just a map[string]string and can me manipulated as so.
-// Keys (header names) starting with "-" (e.g. "-Server") will cause the header to be deleted. Keys starting with "+", will cause the value to be appended to the header name, and keys without any prefix will set the value regardless of any previous value.
+// HeaderChanger is just a map[string]string and can me manipulated as so. Header names are case-insensitive, and the prefix of each key selects what to do with the header:
+//
+//	"Name"   sets the header to the value, regardless of any previous value
+//	"+Name"  appends the value to the header, keeping previous values
+//	"-Name"  deletes the header along with all its values. The value is ignored.
+//	"~Name"  removes only the values of the header matching the value, which is a regex, e.g. {"~Set-Cookie": "^_ga="}
+//	"=Name"  replaces a single value with another, written as "old -> new", e.g. {"=Vary": "Cookie -> Accept-Encoding"}
+//
+// Changes are applied in the same order, starting with deletions and ending with appends, so {"-Vary": "", "+Vary": "Origin"} leaves a single value.
+// Comma-separated lists, such as "Vary: Cookie, Origin", are split into their elements for "~" and "=", and the
+// elements left are joined back. Headers whose values can contain commas, such as Set-Cookie or dates, are never split.
+// Changes with an invalid regex or replacement fail as a whole, leaving the headers untouched, which is reported as
+// an error by MiddlewareErr and MangleErr, and logged by Middleware and Mangle.
 type HeaderChanger map[string]string
 
+const (
+	headerReplaceSeparator = " -> "
+	maxHeaderRegexes       = 256
+)
+
+// headerChangeOrder is the order in which changes are applied, by key prefix
+var headerChangeOrder = map[byte]int{'-': 0, '~': 1, '=': 2, '+': 4}
+
+const headerSetOrder = 3
+
+// unsplittableHeaders are the headers whose values can contain commas, so they are not split into list elements
+var unsplittableHeaders = map[string]bool{
+	"Set-Cookie":          true,
+	"Cookie":              true,
+	"Date":                true,
+	"Expires":             true,
+	"Last-Modified":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+	"If-Range":            true,
+	"Retry-After":         true,
+	"User-Agent":          true,
+	"Server":              true,
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Www-Authenticate":    true,
+	"Proxy-Authenticate":  true,
+}
+
+// headerRegexes caches the regexes used to remove values, as HeaderChanger cannot hold them. It is emptied when it
+// grows over maxHeaderRegexes, so patterns of HeaderChangers no longer in use do not pile up.
+var headerRegexes = struct {
+	sync.Mutex
+	regexes map[string]*regexp.Regexp
+}{regexes: make(map[string]*regexp.Regexp)}
+
 func (ha HeaderChanger) Middleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		ha.changeHeaders(r.Header)
+		if err := ha.changeHeaders(r.Header); err != nil {
+			log.Printf("%s, request sent unmodified\n", err.Error())
+		}
 		handler.ServeHTTP(rw, r)
 	})
 }
 
+// MiddlewareErr changes the headers of the request, returning an error if any of the changes is not valid
+func (ha HeaderChanger) MiddlewareErr(r *http.Request) error {
+	return ha.changeHeaders(r.Header)
+}
+
 func (ha HeaderChanger) Mangle(response *http.Response) *http.Response {
-	ha.changeHeaders(response.Header)
+	if err := ha.changeHeaders(response.Header); err != nil {
+		log.Printf("%s, response sent unmodified\n", err.Error())
+	}
 	return response
 }
 
-func (ha HeaderChanger) changeHeaders(headers http.Header) {
+// MangleErr changes the headers of the response, returning an error if any of the changes is not valid
+func (ha HeaderChanger) MangleErr(response *http.Response) (*http.Response, error) {
+	return response, ha.changeHeaders(response.Header)
+}
+
+// validate returns an error if any of the regexes or replacements of the HeaderChanger is not valid
+func (ha HeaderChanger) validate() error {
 	for key, value := range ha {
-		if strings.HasPrefix(key, "-") {
-			headers.Del(key[1:])
-		} else if strings.HasPrefix(key, "+") {
-			headers.Add(key[1:], value)
-		} else {
+		switch {
+		case strings.HasPrefix(key, "~"):
+			if _, err := headerRegex(value); err != nil {
+				return fmt.Errorf("invalid regex for header %s: %v", key[1:], err)
+			}
+		case strings.HasPrefix(key, "="):
+			if !strings.Contains(value, headerReplaceSeparator) {
+				return fmt.Errorf("replacement for header %s must be written as %q", key[1:], "old"+headerReplaceSeparator+"new")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ha HeaderChanger) changeHeaders(headers http.Header) error {
+	if err := ha.validate(); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(ha))
+	for key := range ha {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if ri, rj := headerChangeRank(keys[i]), headerChangeRank(keys[j]); ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		value := ha[key]
+		switch headerChangeRank(key) {
+		case headerChangeOrder['-']:
+			deleteHeader(headers, key[1:])
+		case headerChangeOrder['~']:
+			regex, _ := headerRegex(value)
+			filterHeaderValues(headers, key[1:], func(v string) (string, bool) {
+				return v, !regex.MatchString(v)
+			})
+		case headerChangeOrder['=']:
+			separator := strings.Index(value, headerReplaceSeparator)
+			old, replacement := value[:separator], value[separator+len(headerReplaceSeparator):]
+			filterHeaderValues(headers, key[1:], func(v string) (string, bool) {
+				if v == old {
+					return replacement, true
+				}
+				return v, true
+			})
+		case headerChangeOrder['+']:
+			name := existingHeaderKey(headers, key[1:])
+			headers[name] = append(headers[name], value)
+		default:
+			deleteHeader(headers, key)
 			headers.Set(key, value)
 		}
 	}
+
+	return nil
+}
+
+func headerChangeRank(key string) int {
+	if key != "" {
+		if rank, isPrefix := headerChangeOrder[key[0]]; isPrefix {
+			return rank
+		}
+	}
+
+	return headerSetOrder
+}
+
+func headerRegex(pattern string) (*regexp.Regexp, error) {
+	headerRegexes.Lock()
+	defer headerRegexes.Unlock()
+
+	if regex, exists := headerRegexes.regexes[pattern]; exists {
+		return regex, nil
+	}
+
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(headerRegexes.regexes) >= maxHeaderRegexes {
+		headerRegexes.regexes = make(map[string]*regexp.Regexp)
+	}
+	headerRegexes.regexes[pattern] = regex
+
+	return regex, nil
+}
+
+// deleteHeader deletes the header called name, compared case-insensitively, so values stored under non-canonical keys
+// are deleted as well
+func deleteHeader(headers http.Header, name string) {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			delete(headers, key)
+		}
+	}
+}
+
+// existingHeaderKey returns the key values of the header called name are stored under, or its canonical form if there
+// are none
+func existingHeaderKey(headers http.Header, name string) string {
+	canonical := http.CanonicalHeaderKey(name)
+	if _, exists := headers[canonical]; exists {
+		return canonical
+	}
+
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+
+	return canonical
+}
+
+// filterHeaderValues passes every value of the header called name, compared case-insensitively, through filter, which
+// returns the value to keep in its place or false to remove it. Lists are filtered element by element, unless the
+// header is one of unsplittableHeaders. The header is deleted if no values are left.
+func filterHeaderValues(headers http.Header, name string, filter func(string) (string, bool)) {
+	split := !unsplittableHeaders[http.CanonicalHeaderKey(name)]
+
+	for key, values := range headers {
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+
+		filtered := make([]string, 0, len(values))
+		for _, value := range values {
+			if !split {
+				if value, keep := filter(value); keep {
+					filtered = append(filtered, value)
+				}
+				continue
+			}
+
+			elements := splitHeaderList(value)
+			kept := make([]string, 0, len(elements))
+			changed := false
+			for _, element := range elements {
+				mangled, keep := filter(element)
+				changed = changed || !keep || mangled != element
+				if keep {
+					kept = append(kept, mangled)
+				}
+			}
+
+			switch {
+			case !changed:
+				filtered = append(filtered, value)
+			case len(kept) > 0:
+				filtered = append(filtered, strings.Join(kept, ", "))
+			}
+		}
+
+		if len(filtered) == 0 {
+			delete(headers, key)
+		} else {
+			headers[key] = filtered
+		}
+	}
+}
+
+// splitHeaderList splits a comma-separated list into its elements, as in RFC 7230, section 7. Commas within quoted
+// strings or URIs enclosed in angle brackets, as in Link headers, do not separate elements.
+func splitHeaderList(value string) []string {
+	var elements []string
+	quoted, bracketed, escaped := false, false, false
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			bracketed = true
+		case c == '>':
+			bracketed = false
+		case c == ',' && !bracketed:
+			if element := strings.TrimSpace(value[start:i]); element != "" {
+				elements = append(elements, element)
+			}
+			start = i + 1
+		}
+	}
+
+	if element := strings.TrimSpace(value[start:]); element != "" {
+		elements = append(elements, element)
+	}
+
+	return elements
 }
@@ -129,3 +129,96 @@ func TestHeaderChangerResponse(t *testing.T) {
 		t.Error("New header wasn't set")
 	}
 }
+
+func TestHeaderChangerValues(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Set-Cookie", "_ga=1; Path=/")
+	headers.Add("Set-Cookie", "session=abc")
+	headers.Add("Set-Cookie", "_ga_ID=2")
+	headers.Add("Vary", "Cookie")
+	headers.Add("Vary", "Origin")
+
+	changer := HeaderChanger{}
+	changer["~set-cookie"] = "^_ga"
+	changer["=vary"] = "Cookie -> Accept-Encoding"
+	changer.changeHeaders(headers)
+
+	if strings.Join(headers["Set-Cookie"], ", ") != "session=abc" {
+		t.Errorf("Matching values weren't removed: %v", headers["Set-Cookie"])
+	}
+
+	if strings.Join(headers["Vary"], ", ") != "Accept-Encoding, Origin" {
+		t.Errorf("Value wasn't replaced: %v", headers["Vary"])
+	}
+
+	changer["~Set-Cookie"] = "."
+	changer.changeHeaders(headers)
+	if _, exists := headers["Set-Cookie"]; exists {
+		t.Errorf("Header with no values left wasn't deleted: %v", headers)
+	}
+}
+
+func TestHeaderChangerLists(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Vary", "Cookie, Origin")
+	headers.Set("Link", `<https://example.org/a,b>; rel="preload, prefetch", <https://example.org/c>; rel=next`)
+	headers.Set("Set-Cookie", "session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	headers["x-lowercase"] = []string{"set directly"}
+
+	changer := HeaderChanger{}
+	changer["=Vary"] = "Cookie -> Accept-Encoding"
+	changer["~Link"] = "rel=next$"
+	changer["~Set-Cookie"] = "^Wed"
+	changer["-X-Lowercase"] = ""
+	if err := changer.changeHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	if headers.Get("Vary") != "Accept-Encoding, Origin" {
+		t.Errorf("Element of a list was not replaced: %v", headers["Vary"])
+	}
+
+	if headers.Get("Link") != `<https://example.org/a,b>; rel="preload, prefetch"` {
+		t.Errorf("Element of a list was not removed: %v", headers["Link"])
+	}
+
+	if len(headers["Set-Cookie"]) != 1 {
+		t.Errorf("Set-Cookie was split into elements: %v", headers["Set-Cookie"])
+	}
+
+	if _, exists := headers["x-lowercase"]; exists {
+		t.Errorf("Header stored under a non-canonical key was not deleted: %v", headers)
+	}
+}
+
+func TestHeaderChangerInvalid(t *testing.T) {
+	response := tests.GetResponse()
+	changer := HeaderChanger{"~Server": "(", "New": "NewHeader"}
+
+	if _, err := changer.MangleErr(response); err == nil {
+		t.Error("Invalid regex did not return an error")
+	}
+
+	if response.Header.Get("New") != "" {
+		t.Error("Headers were changed although a change is invalid")
+	}
+
+	if err := (HeaderChanger{"=Vary": "Cookie"}).MiddlewareErr(tests.Get()); err == nil {
+		t.Error("Invalid replacement did not return an error")
+	}
+}
+
+func TestHeaderChangerOrder(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Vary", "Cookie")
+	headers.Add("Vary", "Accept")
+
+	changer := HeaderChanger{}
+	changer["+Vary"] = "Origin"
+	changer["-Vary"] = ""
+	changer.changeHeaders(headers)
+
+	if strings.Join(headers["Vary"], ", ") != "Origin" {
+		t.Errorf("Changes were not applied in order: %v", headers["Vary"])
+	}
+}
@@ -0,0 +1,215 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitMaxDelay    = 10 * time.Second
+	defaultRateLimitIdleTimeout = 10 * time.Minute
+)
+
+// RateLimitKey returns the key requests are grouped by, each key having its own bucket
+type RateLimitKey func(r *http.Request) string
+
+// ByClientIP groups requests by the IP address of the client connection. Forwarding headers are ignored, as clients can forge them.
+func ByClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByHost groups requests by the Host they are addressed to
+func ByHost(r *http.Request) string {
+	return r.Host
+}
+
+// ByHeader returns a RateLimitKey which groups requests by the value of a header
+func ByHeader(name string) RateLimitKey {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// RateLimitAction is what RateLimiter does with requests over the limit
+type RateLimitAction int
+
+const (
+	RateLimitReject RateLimitAction = iota // Answer with 429 Too Many Requests and a Retry-After header
+	RateLimitDrop                          // Close the connection without answering
+	RateLimitDelay                         // Hold the request until it is within the limit, or reject it if it would wait more than MaxDelay
+)
+
+// RateLimiter is a Middleware which limits the rate of requests using token buckets. Each bucket holds up to Burst
+// tokens and is refilled with Rate tokens per second. Requests take a token from the bucket for their key, and those
+// finding it empty are handled according to Action, without being sent upstream.
+// Buckets which have been idle for IdleTimeout are discarded, so memory usage is bounded by the number of active keys.
+// Buckets belong to each RateLimiter and are not shared, so replacing a RateLimiter, as reloading config does,
+// resets the limits of every key.
+type RateLimiter struct {
+	Rate        float64         // Requests per second allowed for each key
+	Burst       int             // Requests allowed at once for each key. Defaults to 1.
+	Key         RateLimitKey    // Defaults to ByClientIP
+	Action      RateLimitAction // Defaults to RateLimitReject
+	MaxDelay    time.Duration   // Maximum time a request is held with RateLimitDelay. Defaults to 10 seconds.
+	IdleTimeout time.Duration   // Time after which unused buckets are discarded. Defaults to 10 minutes.
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (rl *RateLimiter) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := ByClientIP
+		if rl.Key != nil {
+			key = rl.Key
+		}
+
+		maxDelay := time.Duration(0)
+		if rl.Action == RateLimitDelay {
+			maxDelay = rl.maxDelay()
+		}
+
+		k := key(r)
+		wait, allowed := rl.reserve(k, time.Now(), maxDelay)
+		if !allowed {
+			rl.limit(rw, wait)
+			return
+		}
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				// The request is never sent, so the token reserved for it is given back
+				timer.Stop()
+				rl.refund(k)
+				return
+			}
+		}
+
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// reserve takes a token from the bucket for key. If there is none, a token in the future is reserved if it will be
+// available within maxDelay, and the time to wait for it is returned. Otherwise, allowed is false and wait is the time
+// until a token is available.
+func (rl *RateLimiter) reserve(key string, now time.Time, maxDelay time.Duration) (wait time.Duration, allowed bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	burst := float64(rl.burst())
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	if rl.Rate > 0 {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.Rate)
+	}
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+
+	if rl.Rate <= 0 {
+		return time.Duration(math.MaxInt64), false
+	}
+
+	wait = time.Duration((1 - bucket.tokens) / rl.Rate * float64(time.Second))
+	if wait > maxDelay {
+		return wait, false
+	}
+
+	// Tokens go negative to account for the requests already waiting
+	bucket.tokens--
+	return wait, true
+}
+
+// refund gives back a token reserved by a request which was aborted while waiting for it
+func (rl *RateLimiter) refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if bucket, exists := rl.buckets[key]; exists {
+		bucket.tokens = math.Min(float64(rl.burst()), bucket.tokens+1)
+	}
+}
+
+// sweep discards buckets idle for longer than IdleTimeout. It runs at most once every IdleTimeout. rl.mu must be held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*tokenBucket)
+		rl.lastSweep = now
+		return
+	}
+
+	idleTimeout := rl.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRateLimitIdleTimeout
+	}
+
+	if now.Sub(rl.lastSweep) < idleTimeout {
+		return
+	}
+
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= idleTimeout {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// limit handles a request over the limit, which could be accepted after wait
+func (rl *RateLimiter) limit(rw http.ResponseWriter, wait time.Duration) {
+	if rl.Action == RateLimitDrop {
+		if hijacker, isHijacker := rw.(http.Hijacker); isHijacker {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		// Makes http.Server close the connection without answering nor logging
+		panic(http.ErrAbortHandler)
+	}
+
+	if wait < time.Duration(math.MaxInt64) {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func (rl *RateLimiter) burst() int {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return 1
+}
+
+func (rl *RateLimiter) maxDelay() time.Duration {
+	if rl.MaxDelay > 0 {
+		return rl.MaxDelay
+	}
+	return defaultRateLimitMaxDelay
+}
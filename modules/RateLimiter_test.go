@@ -0,0 +1,142 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+	var served int32
+	handler := (&RateLimiter{Rate: 1, Burst: 2}).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+	}))
+
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.org/", nil))
+		codes = append(codes, rec.Code)
+
+		if i == 2 && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Unexpected Retry-After %q", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status codes %v", codes)
+	}
+
+	if served != 2 {
+		t.Errorf("%d requests reached the handler", served)
+	}
+
+	// Other clients have their own bucket
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error("Request from another client was limited")
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	rl := &RateLimiter{Rate: 1, Key: ByHeader("X-Api-Key")}
+	handler := rl.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	for i, key := range []string{"a", "b", "a"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if expected := i < 2; (rec.Code == http.StatusOK) != expected {
+			t.Errorf("Request %d with key %s: unexpected status %d", i, key, rec.Code)
+		}
+	}
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+	handler := (&RateLimiter{Rate: 20, Action: RateLimitDelay}).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.org/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("Delayed request got status %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first request goes through right away, and the other two wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Requests were not delayed, took %s", elapsed)
+	}
+
+	rl := &RateLimiter{Rate: 1, Action: RateLimitDelay, MaxDelay: 10 * time.Millisecond}
+	rl.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	rec := httptest.NewRecorder()
+	rl.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Request which would wait more than MaxDelay got status %d", rec.Code)
+	}
+}
+
+func TestRateLimiterDelayRefund(t *testing.T) {
+	rl := &RateLimiter{Rate: 10, Action: RateLimitDelay, MaxDelay: 150 * time.Millisecond}
+	handler := rl.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// The second request would wait 100ms, but it is aborted before that
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	// Without the token given back, the third request would have to wait almost 200ms, over MaxDelay
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Token reserved by an aborted request was not given back, got status %d", rec.Code)
+	}
+}
+
+func TestRateLimiterDrop(t *testing.T) {
+	server := httptest.NewServer((&RateLimiter{Rate: 1, Action: RateLimitDrop}).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if response, err := client.Get(server.URL); err == nil {
+		t.Errorf("Request over the limit was answered with %d", response.StatusCode)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	rl := &RateLimiter{Rate: 1, IdleTimeout: time.Minute}
+	now := time.Now()
+
+	rl.reserve("a", now, 0)
+	rl.reserve("b", now.Add(30*time.Second), 0)
+	rl.reserve("c", now.Add(61*time.Second), 0)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, exists := rl.buckets["a"]; exists || len(rl.buckets) != 2 {
+		t.Errorf("Idle buckets were not evicted, %d left", len(rl.buckets))
+	}
+}
@@ -2,15 +2,31 @@ package modules // import "roob.re/goxxy/modules"
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // RegexMangler is a collection of regexes to apply to responses which will be set back to the client, both to the headers and body.
+// Body regexes are applied on the fly as the response is streamed to the client, see RegexTransformer for the implications.
+// Most notably, matches longer than Window bytes are not guaranteed to be replaced. If regexes need to see the whole body
+// at once, or can match long stretches of it, Buffered can be set to true, in which case bodies larger than MaxSize are
+// left untouched.
+// Request bodies can be rewritten too, either as a whole or field by field for forms and JSON documents. As Content-Length
+// must be known before sending them upstream, request bodies are always buffered, and those larger than MaxSize are left untouched.
 type RegexMangler struct {
-	headerRegexes map[string][]regexpReplace
-	bodyRegexes   []regexpReplace
+	Buffered           bool // If set to true, the whole body will be read into memory before applying the regexes.
+	Window             int  // Maximum length of a match when streaming. Defaults to 4096 bytes.
+	headerRegexes      map[string][]regexpReplace
+	bodyRegexes        []regexpReplace
+	requestBodyRegexes []regexpReplace
+	formRegexes        map[string][]regexpReplace
+	jsonRegexes        map[string][]regexpReplace
 	maxSizer
 }
 
@@ -19,70 +35,245 @@ type regexpReplace struct {
 	Replace string
 }
 
-// AddHeaderRegex adds a new regex which will be applied to the headers sent in the response. header is the header name and must match verbatim.
+// AddHeaderRegex adds a new regex which will be applied to every value of a header, both in requests and responses.
+// header is the header name, compared case-insensitively. Values which become empty are removed.
 func (rm *RegexMangler) AddHeaderRegex(header, search, replace string) *RegexMangler {
-	searchRegex := regexp.MustCompile(search)
+	rm.addHeaderRegexp(header, regexp.MustCompile(search), replace)
+	return rm
+}
 
+func (rm *RegexMangler) addHeaderRegexp(header string, search *regexp.Regexp, replace string) {
 	if rm.headerRegexes == nil {
 		rm.headerRegexes = make(map[string][]regexpReplace)
 	}
-	rm.headerRegexes[header] = append(rm.headerRegexes[header], regexpReplace{searchRegex, replace})
-
-	return rm
+	header = http.CanonicalHeaderKey(header)
+	rm.headerRegexes[header] = append(rm.headerRegexes[header], regexpReplace{search, replace})
 }
 
 // AddBodyRegex adds a new regex which will be applied to the response body.
 func (rm *RegexMangler) AddBodyRegex(search, replace string) *RegexMangler {
-	searchRegex := regexp.MustCompile(search)
+	rm.bodyRegexes = append(rm.bodyRegexes, regexpReplace{regexp.MustCompile(search), replace})
+	return rm
+}
+
+// AddRequestBodyRegex adds a new regex which will be applied to the raw request body.
+func (rm *RegexMangler) AddRequestBodyRegex(search, replace string) *RegexMangler {
+	rm.requestBodyRegexes = append(rm.requestBodyRegexes, regexpReplace{regexp.MustCompile(search), replace})
+	return rm
+}
 
-	rm.bodyRegexes = append(rm.bodyRegexes, regexpReplace{searchRegex, replace})
+// AddFormRegex adds a new regex which will be applied to the values of field in url-encoded form requests.
+// Values are unescaped before applying the regex, and the rest of the form is sent verbatim.
+func (rm *RegexMangler) AddFormRegex(field, search, replace string) *RegexMangler {
+	rm.formRegexes = addFieldRegexp(rm.formRegexes, field, regexp.MustCompile(search), replace)
+	return rm
+}
 
+// AddJSONRegex adds a new regex which will be applied to the string values of key, at any depth, in JSON requests.
+// Note the document is encoded again if it is changed, so object keys may be reordered.
+func (rm *RegexMangler) AddJSONRegex(key, search, replace string) *RegexMangler {
+	rm.jsonRegexes = addFieldRegexp(rm.jsonRegexes, key, regexp.MustCompile(search), replace)
 	return rm
 }
 
+func addFieldRegexp(regexes map[string][]regexpReplace, field string, search *regexp.Regexp, replace string) map[string][]regexpReplace {
+	if regexes == nil {
+		regexes = make(map[string][]regexpReplace)
+	}
+	regexes[field] = append(regexes[field], regexpReplace{search, replace})
+	return regexes
+}
+
 func (rm *RegexMangler) Middleware(handler http.Handler) http.Handler {
-	// TODO: Support editing body of the request too
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rm.mangleHeaders(r.Header)
+		rm.mangleRequestBody(r)
 
 		handler.ServeHTTP(w, r)
 	})
 }
 
 func (rm *RegexMangler) Mangle(response *http.Response) *http.Response {
-	if response.ContentLength > rm.maxSize() {
+	if rm.Buffered && response.ContentLength > rm.maxSize() {
 		return response
 	}
 
 	rm.mangleHeaders(response.Header)
 
-	// TODO: Separate this
-	// Check len since we're copying body here
-	if len(rm.bodyRegexes) > 0 {
-		fullBody := CopyBody(response)
+	if len(rm.bodyRegexes) == 0 {
+		return response
+	}
 
+	if !rm.Buffered {
+		transformers := make([]BodyTransformer, 0, len(rm.bodyRegexes))
 		for _, regex := range rm.bodyRegexes {
-			//log.Printf("Searching for %s", regex.Regexp.String())
-			fullBody = regex.Regexp.ReplaceAll(fullBody, []byte(regex.Replace))
+			transformers = append(transformers, RegexTransformer(regex.Regexp, regex.Replace, rm.Window))
 		}
 
-		response.Body = ioutil.NopCloser(bytes.NewReader(fullBody))
+		StreamBody(response, transformers...)
+		return response
+	}
+
+	fullBody, err := BufferBody(response, rm.maxSize())
+	if err != nil {
+		return response
 	}
 
+	for _, regex := range rm.bodyRegexes {
+		fullBody = regex.Regexp.ReplaceAll(fullBody, []byte(regex.Replace))
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(fullBody))
+	response.ContentLength = int64(len(fullBody))
+	response.Header.Set("Content-Length", strconv.Itoa(len(fullBody)))
+
 	return response
 }
 
+// mangleHeaders applies the header regexes to every value of the matching headers, removing values which become empty
 func (rm *RegexMangler) mangleHeaders(header http.Header) {
 	for headerName, valueRegexes := range rm.headerRegexes {
-		for name, headers := range header {
-			// TODO: Paralelize this
-			if name == headerName {
-				//for _, header := range headers { // Ignore multi-valued headers for now
+		for name, values := range header {
+			if !strings.EqualFold(name, headerName) {
+				continue
+			}
+
+			mangled := make([]string, 0, len(values))
+			for _, original := range values {
+				value := original
 				for _, valueRegex := range valueRegexes {
-					headers[0] = valueRegex.Regexp.ReplaceAllString(headers[0], valueRegex.Replace)
+					value = valueRegex.Regexp.ReplaceAllString(value, valueRegex.Replace)
 				}
-				//}
+				if value != "" || original == "" {
+					mangled = append(mangled, value)
+				}
+			}
+
+			if len(mangled) == 0 {
+				delete(header, name)
+			} else {
+				header[name] = mangled
 			}
 		}
 	}
 }
+
+// mangleRequestBody applies the request body, form and JSON regexes, fixing Content-Length if the body is changed.
+// The body is only buffered if any of the regexes can apply to it, given its media type.
+func (rm *RegexMangler) mangleRequestBody(r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isForm := len(rm.formRegexes) > 0 && mediaType == "application/x-www-form-urlencoded"
+	isJSON := len(rm.jsonRegexes) > 0 && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+	if len(rm.requestBodyRegexes) == 0 && !isForm && !isJSON {
+		return
+	}
+
+	body, err := BufferRequestBody(r, rm.maxSize())
+	if err != nil || len(body) == 0 {
+		return
+	}
+
+	mangled := body
+	for _, regex := range rm.requestBodyRegexes {
+		mangled = regex.Regexp.ReplaceAll(mangled, []byte(regex.Replace))
+	}
+
+	switch {
+	case isForm:
+		mangled = mangleForm(mangled, rm.formRegexes)
+	case isJSON:
+		mangled = mangleJSON(mangled, rm.jsonRegexes)
+	}
+
+	if !bytes.Equal(mangled, body) {
+		SetRequestBody(r, mangled)
+	}
+}
+
+// mangleForm applies regexes to the values of an url-encoded form. Pairs which are not changed are kept as they are,
+// so the order and encoding of the form is preserved.
+func mangleForm(body []byte, regexes map[string][]regexpReplace) []byte {
+	pairs := strings.Split(string(body), "&")
+	for i, pair := range pairs {
+		rawKey, rawValue := pair, ""
+		if eq := strings.IndexByte(pair, '='); eq >= 0 {
+			rawKey, rawValue = pair[:eq], pair[eq+1:]
+		}
+
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil || len(regexes[key]) == 0 {
+			continue
+		}
+
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+
+		mangled := value
+		for _, regex := range regexes[key] {
+			mangled = regex.Regexp.ReplaceAllString(mangled, regex.Replace)
+		}
+		if mangled != value {
+			pairs[i] = rawKey + "=" + url.QueryEscape(mangled)
+		}
+	}
+
+	return []byte(strings.Join(pairs, "&"))
+}
+
+// mangleJSON applies regexes to the string values of the matching keys of a JSON document.
+// The body is returned untouched if it is not valid JSON or if no value is changed.
+func mangleJSON(body []byte, regexes map[string][]regexpReplace) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+
+	if !mangleJSONValue(document, regexes) {
+		return body
+	}
+
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return body
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+}
+
+// mangleJSONValue walks a decoded JSON value, replacing string values of matching keys in place. It returns true if
+// any of them changed.
+func mangleJSONValue(value interface{}, regexes map[string][]regexpReplace) bool {
+	changed := false
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if str, isString := child.(string); isString && len(regexes[key]) > 0 {
+				mangled := str
+				for _, regex := range regexes[key] {
+					mangled = regex.Regexp.ReplaceAllString(mangled, regex.Replace)
+				}
+				if mangled != str {
+					v[key] = mangled
+					changed = true
+				}
+				continue
+			}
+
+			changed = mangleJSONValue(child, regexes) || changed
+		}
+	case []interface{}:
+		for _, child := range v {
+			changed = mangleJSONValue(child, regexes) || changed
+		}
+	}
+
+	return changed
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -45,6 +46,29 @@ func TestRegexManglerHeadersResponse(t *testing.T) {
 	}
 }
 
+func TestRegexManglerHeadersMultiValue(t *testing.T) {
+	rm := RegexMangler{}
+	rm.AddHeaderRegex("set-cookie", `^_ga=.*$`, "")
+	rm.AddHeaderRegex("set-cookie", `; Domain=[^;]+`, "")
+
+	resp := tests.GetResponse()
+	resp.Header.Add("Set-Cookie", "session=abc; Domain=example.com")
+	resp.Header.Add("Set-Cookie", "_ga=123")
+	resp.Header.Add("Set-Cookie", "lang=en")
+
+	resp = rm.Mangle(resp)
+
+	if got := strings.Join(resp.Header["Set-Cookie"], " | "); got != "session=abc | lang=en" {
+		t.Errorf("Unexpected Set-Cookie values %q", got)
+	}
+
+	rm.AddHeaderRegex("Set-Cookie", ".+", "")
+	resp = rm.Mangle(resp)
+	if _, exists := resp.Header["Set-Cookie"]; exists {
+		t.Errorf("Header with no values left wasn't deleted: %v", resp.Header)
+	}
+}
+
 func TestRegexManglerBodyResponse(t *testing.T) {
 	const replacing = "https://www.roobre.es/"
 
@@ -65,3 +89,117 @@ func TestRegexManglerBodyResponse(t *testing.T) {
 		t.Error("Text replace failed")
 	}
 }
+
+func TestRegexManglerBodyResponseBuffered(t *testing.T) {
+	rm := RegexMangler{Buffered: true}
+	rm.AddBodyRegex(`(?s)<head>.*</head>`, "")
+
+	resp := rm.Mangle(tests.GetResponse())
+
+	buf := bytes.Buffer{}
+	io.Copy(&buf, resp.Body)
+
+	if strings.Contains(buf.String(), "<title>") {
+		t.Error("Multi-line replace failed")
+	}
+
+	if resp.ContentLength != int64(buf.Len()) {
+		t.Errorf("Content-Length %d does not match body length %d", resp.ContentLength, buf.Len())
+	}
+
+	rm.MaxSize = 4
+	resp = rm.Mangle(tests.GetResponse())
+	buf.Reset()
+	io.Copy(&buf, resp.Body)
+	if buf.String() != tests.ResponseHTML {
+		t.Error("Body larger than MaxSize was modified")
+	}
+}
+
+func TestRegexManglerBodyRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+		mangler     *RegexMangler
+	}{
+		{
+			name:     "raw",
+			body:     "hello world",
+			expected: "hello goxxy",
+			mangler:  (&RegexMangler{}).AddRequestBodyRegex("world", "goxxy"),
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "user=guest&redirect=%2Fhome&other=guest",
+			expected:    "user=root+user&redirect=%2Fhome&other=guest",
+			mangler:     (&RegexMangler{}).AddFormRegex("user", "guest", "root user"),
+		},
+		{
+			name:        "form value not changed",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "user=root%20user&other=guest",
+			expected:    "user=root%20user&other=guest",
+			mangler:     (&RegexMangler{}).AddFormRegex("user", "guest", "root"),
+		},
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"user": "guest", "nested": [{"user": "guest<"}], "other": "guest"}`,
+			expected:    `{"nested":[{"user":"root<"}],"other":"guest","user":"root"}`,
+			mangler:     (&RegexMangler{}).AddJSONRegex("user", "guest", "root"),
+		},
+		{
+			name:        "json with other content type",
+			contentType: "text/plain",
+			body:        `{"user": "guest"}`,
+			expected:    `{"user": "guest"}`,
+			mangler:     (&RegexMangler{}).AddJSONRegex("user", "guest", "root"),
+		},
+		{
+			name:     "too large",
+			body:     "hello world",
+			expected: "hello world",
+			mangler: func() *RegexMangler {
+				rm := &RegexMangler{}
+				rm.MaxSize = 4
+				return rm.AddRequestBodyRegex("world", "goxxy")
+			}(),
+		},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+
+		tc.mangler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != tc.expected {
+				t.Errorf("%s: expected body %q, got %q", tc.name, tc.expected, body)
+			}
+
+			if r.ContentLength != int64(len(tc.expected)) {
+				t.Errorf("%s: Content-Length not fixed: %d", tc.name, r.ContentLength)
+			}
+
+			if tc.expected != tc.body && r.Header.Get("Content-Length") != fmt.Sprint(len(tc.expected)) {
+				t.Errorf("%s: Content-Length header not fixed: %s", tc.name, r.Header.Get("Content-Length"))
+			}
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestRegexManglerRequestBodyNotBuffered(t *testing.T) {
+	rm := (&RegexMangler{}).AddFormRegex("user", "guest", "root").AddJSONRegex("user", "guest", "root")
+
+	body := ioutil.NopCloser(strings.NewReader("user=guest"))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Body = body
+	req.Header.Set("Content-Type", "text/plain")
+
+	rm.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != body {
+			t.Error("Body was buffered although no regex can apply to it")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
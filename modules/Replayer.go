@@ -0,0 +1,386 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplayMatch is a set of flags controlling how strictly a Replayer compares requests against recorded entries.
+// Method and path are always compared.
+type ReplayMatch uint8
+
+const (
+	ReplayMatchHost  ReplayMatch = 1 << iota // Scheme and host must be equal
+	ReplayMatchQuery                         // Query parameters must be equal, regardless of their order
+	ReplayMatchBody                          // Request bodies must be equal
+
+	DefaultReplayMatch = ReplayMatchHost | ReplayMatchQuery
+)
+
+// ReplayFallback tells a Replayer what to do with requests which do not match any entry
+type ReplayFallback uint8
+
+const (
+	ReplayNotFound    ReplayFallback = iota // Answer with 404 Not Found
+	ReplayPassThrough                       // Send the request upstream using Next
+	ReplayNearest                           // Answer with the most similar entry
+)
+
+const maxReplayBodySize = 16 * 1024 * 1024
+
+// Replayer answers requests from a recorded HAR archive, without contacting any upstream server.
+// It can be used as the transport of the Client of a Goxxy node, so its manglers work on the recorded responses, or as
+// a standalone http.Handler.
+// When several entries match a request, they are returned in turns, in the order they were recorded.
+// Entries whose response body was truncated when recorded, as HARRecorder does with bodies over its MaxBodySize, are
+// never replayed, as they would be taken for complete responses.
+type Replayer struct {
+	Match    ReplayMatch       // Strictness of the comparison. Set to DefaultReplayMatch by NewReplayer.
+	Fallback ReplayFallback    // What to do with requests which do not match any entry
+	Stage    string            // If set, only entries recorded at this stage are used. Useful for archives recorded with HARRecorder.Stage.
+	Next     http.RoundTripper // Used by ReplayPassThrough. Defaults to http.DefaultTransport.
+
+	entries []HAREntry
+
+	mu    sync.Mutex
+	turns map[string]int
+}
+
+// NewReplayer returns a Replayer serving the entries of har
+func NewReplayer(har *HAR) *Replayer {
+	return &Replayer{Match: DefaultReplayMatch, entries: har.Log.Entries, turns: make(map[string]int)}
+}
+
+// LoadReplayer reads a HAR archive in JSON format and returns a Replayer serving its entries.
+// The input can hold several archives one after another, as HARRecorder writes when flushed repeatedly to the same file,
+// in which case the entries of all of them are served.
+func LoadReplayer(r io.Reader) (*Replayer, error) {
+	har := &HAR{}
+	decoder := json.NewDecoder(r)
+	for {
+		archive := HAR{}
+		if err := decoder.Decode(&archive); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error decoding HAR archive: %v", err)
+		}
+
+		har.Log.Entries = append(har.Log.Entries, archive.Log.Entries...)
+	}
+
+	return NewReplayer(har), nil
+}
+
+// RoundTrip implements http.RoundTripper, answering with the recorded response matching the request.
+// The request is not modified. Requests passed to Next are a copy of it with the same body.
+func (rp *Replayer) RoundTrip(r *http.Request) (*http.Response, error) {
+	response, outreq, err := rp.replay(r)
+	if err != nil || response != nil {
+		return response, err
+	}
+
+	next := rp.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(outreq)
+}
+
+// replay returns the response to r according to Match and Fallback. If the request must be passed through, a nil
+// response is returned along with a copy of r with the same body.
+func (rp *Replayer) replay(r *http.Request) (*http.Response, *http.Request, error) {
+	body, outreq, err := replayRequestBody(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entry := rp.find(r.Method, r.URL, body); entry != nil {
+		return replayResponse(entry, r), nil, nil
+	}
+
+	switch rp.Fallback {
+	case ReplayPassThrough:
+		return nil, outreq, nil
+	case ReplayNearest:
+		if entry := rp.nearest(r.Method, r.URL, body); entry != nil {
+			return replayResponse(entry, r), nil, nil
+		}
+	}
+
+	return notFoundResponse(r), nil, nil
+}
+
+// ServeHTTP implements http.Handler, so the Replayer can be used as a standalone server
+func (rp *Replayer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rp.serve(rw, r, nil)
+}
+
+// Middleware answers requests from the archive, so the Replayer can be added to a Goxxy node as a module.
+// Requests answered from the archive are neither sent upstream nor mangled by the node. With ReplayPassThrough,
+// requests which do not match any entry are handled by the node as usual, instead of being sent to Next.
+func (rp *Replayer) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rp.serve(rw, r, handler)
+	})
+}
+
+// serve answers r from the archive. If next is not nil, requests passed through are served by it instead of Next.
+func (rp *Replayer) serve(rw http.ResponseWriter, r *http.Request, next http.Handler) {
+	outreq := r.WithContext(r.Context())
+	u := *r.URL
+	if !u.IsAbs() {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		u.Host = r.Host
+	}
+	outreq.URL = &u
+
+	var response *http.Response
+	var err error
+	if next == nil {
+		response, err = rp.RoundTrip(outreq)
+	} else {
+		var passed *http.Request
+		if response, passed, err = rp.replay(outreq); err == nil && response == nil {
+			passed.URL = r.URL
+			next.ServeHTTP(rw, passed)
+			return
+		}
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	for name, values := range response.Header {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(response.StatusCode)
+	io.Copy(rw, response.Body)
+}
+
+// find returns the next entry matching the request, or nil if there is none
+func (rp *Replayer) find(method string, u *url.URL, body []byte) *HAREntry {
+	var matches []*HAREntry
+	for i := range rp.entries {
+		entry := &rp.entries[i]
+		if !rp.replayable(entry) {
+			continue
+		}
+
+		if rp.matches(entry, method, u, body) {
+			matches = append(matches, entry)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	key := method + " " + u.String()
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.turns == nil {
+		rp.turns = make(map[string]int)
+	}
+	turn := rp.turns[key]
+	rp.turns[key] = turn + 1
+
+	return matches[turn%len(matches)]
+}
+
+// replayable returns true if the entry was recorded at the right stage and its response body is complete
+func (rp *Replayer) replayable(entry *HAREntry) bool {
+	if rp.Stage != "" && entry.Stage != rp.Stage {
+		return false
+	}
+
+	return int64(len(responseBody(entry))) >= entry.Response.Content.Size
+}
+
+func (rp *Replayer) matches(entry *HAREntry, method string, u *url.URL, body []byte) bool {
+	recorded, err := url.Parse(entry.Request.URL)
+	if err != nil || entry.Request.Method != method || recorded.Path != u.Path {
+		return false
+	}
+
+	if rp.Match&ReplayMatchHost != 0 && (recorded.Scheme != u.Scheme || recorded.Host != u.Host) {
+		return false
+	}
+
+	if rp.Match&ReplayMatchQuery != 0 && !sameQuery(recorded.Query(), u.Query()) {
+		return false
+	}
+
+	if rp.Match&ReplayMatchBody != 0 && !bytes.Equal(recordedBody(entry), body) {
+		return false
+	}
+
+	return true
+}
+
+// nearest returns the entry most similar to the request, prioritizing path, then method, host, query and body
+func (rp *Replayer) nearest(method string, u *url.URL, body []byte) *HAREntry {
+	var best *HAREntry
+	bestScore := -1
+
+	for i := range rp.entries {
+		entry := &rp.entries[i]
+		if !rp.replayable(entry) {
+			continue
+		}
+
+		recorded, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			continue
+		}
+
+		score := 16 * commonPathSegments(recorded.Path, u.Path)
+		if entry.Request.Method == method {
+			score += 8
+		}
+		if recorded.Host == u.Host {
+			score += 4
+		}
+		if sameQuery(recorded.Query(), u.Query()) {
+			score += 2
+		}
+		if bytes.Equal(recordedBody(entry), body) {
+			score++
+		}
+
+		if score > bestScore {
+			best, bestScore = entry, score
+		}
+	}
+
+	return best
+}
+
+func sameQuery(a, b url.Values) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, values := range a {
+		other := b[key]
+		if len(values) != len(other) {
+			return false
+		}
+		for i := range values {
+			if values[i] != other[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func commonPathSegments(a, b string) int {
+	as, bs := strings.Split(strings.Trim(a, "/"), "/"), strings.Split(strings.Trim(b, "/"), "/")
+	common := 0
+	for common < len(as) && common < len(bs) && as[common] == bs[common] {
+		common++
+	}
+
+	return common
+}
+
+func recordedBody(entry *HAREntry) []byte {
+	if entry.Request.PostData == nil {
+		return nil
+	}
+
+	return []byte(entry.Request.PostData.Text)
+}
+
+// replayRequestBody reads the request body so it can be compared. It returns a copy of r whose body can still be read
+// from the beginning, leaving r untouched.
+func replayRequestBody(r *http.Request) ([]byte, *http.Request, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, r, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReplayBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outreq := r.WithContext(r.Context())
+	outreq.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+	if len(body) == 0 {
+		return nil, outreq, nil
+	}
+
+	return body, outreq, nil
+}
+
+// responseBody returns the recorded response body of the entry, decoding it if needed
+func responseBody(entry *HAREntry) []byte {
+	content := entry.Response.Content
+	if content.Encoding == "base64" {
+		if decoded, err := base64.StdEncoding.DecodeString(content.Text); err == nil {
+			return decoded
+		}
+	}
+
+	return []byte(content.Text)
+}
+
+// replayResponse builds an http.Response from a recorded entry
+func replayResponse(entry *HAREntry, r *http.Request) *http.Response {
+	body := responseBody(entry)
+
+	header := http.Header{}
+	for _, h := range entry.Response.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        strconv.Itoa(entry.Response.Status) + " " + http.StatusText(entry.Response.Status),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+func notFoundResponse(r *http.Request) *http.Response {
+	body := "No recorded response for " + r.Method + " " + r.URL.String() + "\n"
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        "404 Not Found",
+		StatusCode:    http.StatusNotFound,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
@@ -0,0 +1,155 @@
+package modules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy"
+	"roob.re/goxxy/tests"
+	"strings"
+	"testing"
+)
+
+func testArchive() *HAR {
+	entry := func(method, url, postData string, status int, body string) HAREntry {
+		e := HAREntry{}
+		e.Request.Method = method
+		e.Request.URL = url
+		if postData != "" {
+			e.Request.PostData = &HARPostData{Text: postData}
+		}
+		e.Response.Status = status
+		e.Response.Headers = []HARNameValue{{"Content-Type", "text/html"}}
+		e.Response.Content.Text = body
+		return e
+	}
+
+	return &HAR{Log: HARLog{Version: "1.2", Entries: []HAREntry{
+		entry(http.MethodGet, "http://www.example.org/items?b=2&a=1", "", http.StatusOK, tests.ResponseHTML),
+		entry(http.MethodPost, "http://www.example.org/login", "user=perry", http.StatusOK, "welcome perry"),
+		entry(http.MethodPost, "http://www.example.org/login", "user=doof", http.StatusForbidden, "go away"),
+		entry(http.MethodGet, "http://www.example.org/poll", "", http.StatusOK, "first"),
+		entry(http.MethodGet, "http://www.example.org/poll", "", http.StatusOK, "second"),
+	}}}
+}
+
+func replay(t *testing.T, handler http.Handler, method, url, body string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return rec.Code, rec.Body.String()
+}
+
+func TestReplayerMatching(t *testing.T) {
+	rp := NewReplayer(testArchive())
+
+	if code, body := replay(t, rp, http.MethodGet, "http://www.example.org/items?a=1&b=2", ""); code != http.StatusOK || body != tests.ResponseHTML {
+		t.Errorf("Query in different order did not match: %d", code)
+	}
+
+	if code, _ := replay(t, rp, http.MethodGet, "http://www.example.org/items", ""); code != http.StatusNotFound {
+		t.Errorf("Missing query matched with ReplayMatchQuery: %d", code)
+	}
+
+	if code, _ := replay(t, rp, http.MethodGet, "http://other.example/items?a=1&b=2", ""); code != http.StatusNotFound {
+		t.Errorf("Different host matched with ReplayMatchHost: %d", code)
+	}
+
+	rp.Match = ReplayMatchBody
+	if code, body := replay(t, rp, http.MethodPost, "http://other.example/login", "user=doof"); code != http.StatusForbidden || body != "go away" {
+		t.Errorf("Body did not select the right entry: %d %s", code, body)
+	}
+
+	if _, first := replay(t, rp, http.MethodGet, "/poll", ""); first != "first" {
+		t.Errorf("Unexpected first turn: %s", first)
+	}
+	if _, second := replay(t, rp, http.MethodGet, "/poll", ""); second != "second" {
+		t.Errorf("Unexpected second turn: %s", second)
+	}
+}
+
+func TestReplayerFallbacks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("live"))
+	}))
+	defer upstream.Close()
+
+	rp := NewReplayer(testArchive())
+
+	rp.Fallback = ReplayNearest
+	if _, body := replay(t, rp, http.MethodGet, "http://www.example.org/items/42", ""); body != tests.ResponseHTML {
+		t.Errorf("Nearest entry was not returned: %s", body)
+	}
+
+	rp.Fallback = ReplayPassThrough
+	if _, body := replay(t, rp, http.MethodGet, upstream.URL+"/unrecorded", ""); body != "live" {
+		t.Errorf("Request was not passed through: %s", body)
+	}
+}
+
+func TestReplayerAsTransport(t *testing.T) {
+	out := &bytes.Buffer{}
+	recorder := &HARRecorder{Output: out}
+	ioutil.ReadAll(recorder.Mangle(tests.GetResponse()).Body)
+	recorder.Flush()
+
+	rp, err := LoadReplayer(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rm := &RegexMangler{}
+	rm.AddBodyRegex(`example\.org`, "roobre.es")
+
+	g := goxxy.New()
+	g.Client = &http.Client{Transport: rp}
+	g.AddMangler(rm)
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tests.RequestURL, nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	if rec.Code != http.StatusOK || !strings.Contains(string(body), "roobre.es") {
+		t.Errorf("Recorded response was not mangled: %d %s", rec.Code, body)
+	}
+
+	if _, err := LoadReplayer(strings.NewReader("{")); err == nil {
+		t.Error("Invalid archive was loaded")
+	}
+}
+
+func TestReplayerTruncated(t *testing.T) {
+	har := testArchive()
+	truncated := har.Log.Entries[0]
+	truncated.Request.URL = "http://www.example.org/large"
+	truncated.Response.Content.Text = tests.ResponseHTML[:10]
+	truncated.Response.Content.Size = int64(len(tests.ResponseHTML))
+	truncated.Response.Content.Comment = "truncated"
+	har.Log.Entries = append(har.Log.Entries, truncated)
+
+	rp := NewReplayer(har)
+	if code, body := replay(t, rp, http.MethodGet, "http://www.example.org/large", ""); code != http.StatusNotFound {
+		t.Errorf("Truncated entry was replayed: %d %s", code, body)
+	}
+}
+
+func TestReplayerDoesNotModifyRequest(t *testing.T) {
+	rp := NewReplayer(testArchive())
+	rp.Match = ReplayMatchBody
+
+	req := httptest.NewRequest(http.MethodPost, "http://www.example.org/login", strings.NewReader("user=perry"))
+	body := req.Body
+
+	response, err := rp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Body != body {
+		t.Error("RoundTrip replaced the body of the request")
+	}
+
+	if response.Request != req {
+		t.Error("Response does not point to the original request")
+	}
+}
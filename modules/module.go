@@ -2,8 +2,11 @@ package modules // import "roob.re/goxxy/modules"
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
 const defaultResponseBufferSize = 1024
@@ -35,8 +38,12 @@ func (b bufferCloser) Close() error {
 	return nil
 }
 
+// ErrBodyTooLarge is returned by BufferBody if the body exceeds the maximum size allowed
+var ErrBodyTooLarge = errors.New("body exceeds maximum buffering size")
+
 // CopyBody reads the whole response body into a io.Buffer, and returns the slice of bytes from it as well as the reader buffer. It also sets the response body to the new Buffer.
 // Warning: changes to the returned byte slice may not be reflected into the response automatically, if it is resliced somewhere. If you're unsure, re-set response.Body to a new buffer from the slice again.
+// CopyBody does not limit the amount of data read. Modules which can work on a stream should use StreamBody instead, and those which need the full body should prefer BufferBody.
 func CopyBody(response *http.Response) (body []byte) {
 	// If we already did the copy (response.Body implements `Bytes()`) and the buffer is unread (UnreadByte returns non-nil), just return those bytes
 	if byter, isBuffer := response.Body.(byter); isBuffer && byter.UnreadByte() != nil {
@@ -54,3 +61,68 @@ func CopyBody(response *http.Response) (body []byte) {
 	response.Body = bufferCloser{buffer}
 	return buffer.Bytes()
 }
+
+// BufferBody is the bounded version of CopyBody: it reads the whole response body into memory as long as it is not larger than maxSize.
+// If the body is larger, ErrBodyTooLarge is returned and response.Body is restored, so it can still be sent to the client untouched.
+// The same happens if reading fails, in which case the error is returned and the client will receive the same error when reading.
+func BufferBody(response *http.Response, maxSize int64) ([]byte, error) {
+	if byter, isBuffer := response.Body.(byter); isBuffer && byter.UnreadByte() != nil {
+		if int64(len(byter.Bytes())) > maxSize {
+			return nil, ErrBodyTooLarge
+		}
+		return byter.Bytes(), nil
+	}
+
+	if response.ContentLength > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+
+	responseLen := response.ContentLength
+	if responseLen < 0 {
+		responseLen = defaultResponseBufferSize
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, responseLen))
+
+	n, err := io.CopyN(buffer, response.Body, maxSize+1)
+	if n > maxSize || (err != nil && err != io.EOF) {
+		// Put back what we read, so the body is not truncated
+		response.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(buffer.Bytes()), response.Body), Closer: response.Body}
+		if err == nil {
+			err = ErrBodyTooLarge
+		}
+		return nil, err
+	}
+
+	response.Body.Close()
+	response.Body = bufferCloser{buffer}
+	return buffer.Bytes(), nil
+}
+
+// BufferRequestBody is the request counterpart of BufferBody: it reads the whole request body into memory as long as it
+// is not larger than maxSize, leaving r.Body readable either way.
+func BufferRequestBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	wrapper := &http.Response{Body: r.Body, ContentLength: r.ContentLength}
+	body, err := BufferBody(wrapper, maxSize)
+	r.Body = wrapper.Body
+	return body, err
+}
+
+// SetRequestBody replaces the body of the request, fixing Content-Length accordingly
+func SetRequestBody(r *http.Request, body []byte) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
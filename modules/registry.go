@@ -0,0 +1,491 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"roob.re/goxxy"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	goxxy.RegisterModule("regex", newRegexMangler)
+	goxxy.RegisterModule("headers", newHeaderChanger)
+	goxxy.RegisterFileModule("formdumper", newFormDumper)
+	goxxy.RegisterModule("html", newHTMLMangler)
+	goxxy.RegisterModule("echo", newEchoMangler)
+	goxxy.RegisterModule("ratelimit", newRateLimiter)
+	goxxy.RegisterFileModule("accesslog", newAccessLog)
+	goxxy.RegisterFileModule("har", newHARRecorder)
+	goxxy.RegisterFileModule("replay", newReplayer)
+}
+
+// rotatingFiles holds the files opened by factories, so modules writing to the same path, such as the ones built again
+// when config is reloaded, share the same writer
+var rotatingFiles = struct {
+	sync.Mutex
+	files map[string]*RotatingFile
+}{files: make(map[string]*RotatingFile)}
+
+// rotatingFile returns the RotatingFile for path, creating it if it does not exist yet. The limits of an existing file
+// are changed to the given ones, so a reloaded config changing them takes effect.
+func rotatingFile(path string, maxSize int64, maxBackups int) *RotatingFile {
+	rotatingFiles.Lock()
+	defer rotatingFiles.Unlock()
+
+	rf, exists := rotatingFiles.files[path]
+	if !exists {
+		rf = &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+		rotatingFiles.files[path] = rf
+		return rf
+	}
+
+	rf.setLimits(maxSize, maxBackups)
+	return rf
+}
+
+// appendFiles holds the files opened for appending by factories, shared by path as rotatingFiles are, so building
+// modules again does not open them again
+var appendFiles = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: make(map[string]*os.File)}
+
+// appendFile returns the file at path opened for appending, opening it if it was not open yet
+func appendFile(path string) (*os.File, error) {
+	appendFiles.Lock()
+	defer appendFiles.Unlock()
+
+	if file, exists := appendFiles.files[path]; exists {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	appendFiles.files[path] = file
+	return file, nil
+}
+
+// newRegexMangler builds a RegexMangler from parameters such as
+// {"buffered": false, "window": 4096, "maxSize": 1048576, "headers": [{"header": "Server", "search": ".*", "replace": "goxxy"}], "body": [{"search": "foo", "replace": "bar"}]}
+// Request bodies are rewritten with "requestBody", which takes the same entries as "body", and "form" and "json", whose
+// entries name the field they apply to, as in {"field": "user", "search": ".*", "replace": "admin"}.
+func newRegexMangler(decode goxxy.Decoder) (interface{}, error) {
+	type regexParams struct {
+		Header  string `json:"header" yaml:"header"`
+		Field   string `json:"field" yaml:"field"`
+		Search  string `json:"search" yaml:"search"`
+		Replace string `json:"replace" yaml:"replace"`
+	}
+
+	var params struct {
+		Buffered    bool          `json:"buffered" yaml:"buffered"`
+		Window      int           `json:"window" yaml:"window"`
+		MaxSize     int64         `json:"maxSize" yaml:"maxSize"`
+		Headers     []regexParams `json:"headers" yaml:"headers"`
+		Body        []regexParams `json:"body" yaml:"body"`
+		RequestBody []regexParams `json:"requestBody" yaml:"requestBody"`
+		Form        []regexParams `json:"form" yaml:"form"`
+		JSON        []regexParams `json:"json" yaml:"json"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	rm := &RegexMangler{Buffered: params.Buffered, Window: params.Window}
+	rm.MaxSize = params.MaxSize
+
+	for _, header := range params.Headers {
+		search, err := regexp.Compile(header.Search)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for header %s: %v", header.Header, err)
+		}
+		rm.addHeaderRegexp(header.Header, search, header.Replace)
+	}
+
+	for _, body := range params.Body {
+		search, err := regexp.Compile(body.Search)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body regex: %v", err)
+		}
+		rm.bodyRegexes = append(rm.bodyRegexes, regexpReplace{search, body.Replace})
+	}
+
+	for _, body := range params.RequestBody {
+		search, err := regexp.Compile(body.Search)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request body regex: %v", err)
+		}
+		rm.requestBodyRegexes = append(rm.requestBodyRegexes, regexpReplace{search, body.Replace})
+	}
+
+	for _, field := range params.Form {
+		search, err := regexp.Compile(field.Search)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for form field %s: %v", field.Field, err)
+		}
+		rm.formRegexes = addFieldRegexp(rm.formRegexes, field.Field, search, field.Replace)
+	}
+
+	for _, key := range params.JSON {
+		search, err := regexp.Compile(key.Search)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for json key %s: %v", key.Field, err)
+		}
+		rm.jsonRegexes = addFieldRegexp(rm.jsonRegexes, key.Field, search, key.Replace)
+	}
+
+	return rm, nil
+}
+
+// newHeaderChanger builds a HeaderChanger from an object mapping header names to values, with the same syntax as HeaderChanger itself
+func newHeaderChanger(decode goxxy.Decoder) (interface{}, error) {
+	changer := HeaderChanger{}
+	if err := decode(&changer); err != nil {
+		return nil, err
+	}
+
+	if err := changer.validate(); err != nil {
+		return nil, err
+	}
+
+	return changer, nil
+}
+
+// newFormDumper builds a FormDumper from parameters such as
+// {"output": "forms.log", "tryhardJson": false, "ignoreResponseCode": false, "maxSize": 1048576, "any": [["user", "email"]], "all": [["user", "pass"]]}
+// Forms are dumped to stdout if no output file is set. Output files are shared by all the modules writing to the same path.
+func newFormDumper(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Output             string     `json:"output" yaml:"output"`
+		TryhardJson        bool       `json:"tryhardJson" yaml:"tryhardJson"`
+		IgnoreResponseCode bool       `json:"ignoreResponseCode" yaml:"ignoreResponseCode"`
+		MaxSize            int64      `json:"maxSize" yaml:"maxSize"`
+		Any                [][]string `json:"any" yaml:"any"`
+		All                [][]string `json:"all" yaml:"all"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	var output io.Writer = os.Stdout
+	if params.Output != "" {
+		file, err := appendFile(params.Output)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+
+	dumper := &FormDumper{TryhardJson: params.TryhardJson, IgnoreResponseCode: params.IgnoreResponseCode, Output: output}
+	dumper.MaxSize = params.MaxSize
+	for _, keywords := range params.Any {
+		dumper.Any(keywords...)
+	}
+	for _, keywords := range params.All {
+		dumper.All(keywords...)
+	}
+
+	return dumper, nil
+}
+
+// htmlAction is an HTMLModifier which applies an action to the elements matching a CSS selector.
+// Actions are "remove", "text" and "html" (replace the contents), "append" and "prepend" (insert HTML), and
+// "setAttr" and "removeAttr" (change the attribute Attr).
+type htmlAction struct {
+	Selector string `json:"selector" yaml:"selector"`
+	Action   string `json:"action" yaml:"action"`
+	Attr     string `json:"attr" yaml:"attr"`
+	Value    string `json:"value" yaml:"value"`
+}
+
+func (ha *htmlAction) ModifyHTML(doc *goquery.Document) {
+	selection := doc.Find(ha.Selector)
+
+	switch ha.Action {
+	case "remove":
+		selection.Remove()
+	case "text":
+		selection.SetText(ha.Value)
+	case "html":
+		selection.SetHtml(ha.Value)
+	case "append":
+		selection.AppendHtml(ha.Value)
+	case "prepend":
+		selection.PrependHtml(ha.Value)
+	case "setAttr":
+		selection.SetAttr(ha.Attr, ha.Value)
+	case "removeAttr":
+		selection.RemoveAttr(ha.Attr)
+	}
+}
+
+func (ha *htmlAction) validate() error {
+	if _, err := cascadia.Compile(ha.Selector); err != nil {
+		return fmt.Errorf("invalid selector %q: %v", ha.Selector, err)
+	}
+
+	switch ha.Action {
+	case "remove", "text", "html", "append", "prepend":
+		return nil
+	case "setAttr", "removeAttr":
+		if ha.Attr == "" {
+			return fmt.Errorf("action %s requires an attr", ha.Action)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown html action %q", ha.Action)
+}
+
+// newHTMLMangler builds an HTMLMangler from parameters such as
+// {"maxSize": 1048576, "modifiers": [{"selector": "script", "action": "remove"}, {"selector": "a", "action": "setAttr", "attr": "href", "value": "#"}]}
+func newHTMLMangler(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		MaxSize          int64         `json:"maxSize" yaml:"maxSize"`
+		Modifiers        []*htmlAction `json:"modifiers" yaml:"modifiers"`
+		RequestModifiers []*htmlAction `json:"requestModifiers" yaml:"requestModifiers"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	h := &HTMLMangler{}
+	h.MaxSize = params.MaxSize
+	for _, modifier := range params.Modifiers {
+		if err := modifier.validate(); err != nil {
+			return nil, err
+		}
+		h.AddModifier(modifier)
+	}
+
+	for _, modifier := range params.RequestModifiers {
+		if err := modifier.validate(); err != nil {
+			return nil, err
+		}
+		h.AddRequestModifier(modifier)
+	}
+
+	return h, nil
+}
+
+// newEchoMangler builds an EchoMangler writing to stdout from parameters such as {"prefix": "google:"}
+func newEchoMangler(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Prefix string `json:"prefix" yaml:"prefix"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	return EchoMangler(params.Prefix, os.Stdout), nil
+}
+
+// newRateLimiter builds a RateLimiter from parameters such as
+// {"rate": 10, "burst": 20, "key": "ip", "action": "delay", "maxDelay": "5s", "idleTimeout": "10m"}
+// Keys are "ip", "host" or "header:<name>", and actions are "reject", "drop" or "delay".
+// Each RateLimiter built has its own buckets, so limits start afresh when config is reloaded.
+func newRateLimiter(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Rate        float64 `json:"rate" yaml:"rate"`
+		Burst       int     `json:"burst" yaml:"burst"`
+		Key         string  `json:"key" yaml:"key"`
+		Action      string  `json:"action" yaml:"action"`
+		MaxDelay    string  `json:"maxDelay" yaml:"maxDelay"`
+		IdleTimeout string  `json:"idleTimeout" yaml:"idleTimeout"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	if params.Rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+
+	rl := &RateLimiter{Rate: params.Rate, Burst: params.Burst}
+
+	switch {
+	case params.Key == "" || params.Key == "ip":
+		rl.Key = ByClientIP
+	case params.Key == "host":
+		rl.Key = ByHost
+	case strings.HasPrefix(params.Key, "header:"):
+		rl.Key = ByHeader(strings.TrimPrefix(params.Key, "header:"))
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", params.Key)
+	}
+
+	switch params.Action {
+	case "", "reject":
+		rl.Action = RateLimitReject
+	case "drop":
+		rl.Action = RateLimitDrop
+	case "delay":
+		rl.Action = RateLimitDelay
+	default:
+		return nil, fmt.Errorf("unknown rate limit action %q", params.Action)
+	}
+
+	var err error
+	if rl.MaxDelay, err = parseDuration(params.MaxDelay); err != nil {
+		return nil, err
+	}
+	if rl.IdleTimeout, err = parseDuration(params.IdleTimeout); err != nil {
+		return nil, err
+	}
+
+	return rl, nil
+}
+
+// parseDuration parses an optional duration, returning 0 if it is empty
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// newAccessLog builds an AccessLog from parameters such as
+// {"output": "access.log", "format": "json", "maxSize": 104857600, "maxBackups": 5}
+// Lines are written to stdout if no output file is set. Formats are "combined" and "json". Output files are rotated
+// as in RotatingFile, and shared by all the modules writing to the same path.
+func newAccessLog(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Output     string `json:"output" yaml:"output"`
+		Format     string `json:"format" yaml:"format"`
+		MaxSize    int64  `json:"maxSize" yaml:"maxSize"`
+		MaxBackups int    `json:"maxBackups" yaml:"maxBackups"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	al := &AccessLog{Output: os.Stdout}
+	if params.Output != "" {
+		al.Output = rotatingFile(params.Output, params.MaxSize, params.MaxBackups)
+	}
+
+	switch params.Format {
+	case "", "combined":
+		al.Format = AccessLogCombined
+	case "json":
+		al.Format = AccessLogJSON
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", params.Format)
+	}
+
+	return al, nil
+}
+
+// harStage is a HARRecorder which tags the responses it records with a stage, as HARRecorder.Stage does, while still
+// capturing request bodies and being flushed as a module
+type harStage struct {
+	*HARRecorder
+	stage string
+}
+
+func (hs harStage) Mangle(response *http.Response) *http.Response {
+	return hs.record(response, hs.stage)
+}
+
+// newHARRecorder builds a HARRecorder from parameters such as
+// {"output": "traffic.har", "stage": "pre", "maxBodySize": 1048576, "maxEntries": 1000}
+// Archives are written to stdout if no output file is set. Output files are opened for appending, so each flush adds
+// an archive to them, and are shared by all the modules writing to the same path.
+func newHARRecorder(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Output      string `json:"output" yaml:"output"`
+		Stage       string `json:"stage" yaml:"stage"`
+		MaxBodySize int64  `json:"maxBodySize" yaml:"maxBodySize"`
+		MaxEntries  int    `json:"maxEntries" yaml:"maxEntries"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	recorder := &HARRecorder{Output: os.Stdout, MaxBodySize: params.MaxBodySize, MaxEntries: params.MaxEntries}
+	if params.Output != "" {
+		file, err := appendFile(params.Output)
+		if err != nil {
+			return nil, err
+		}
+		recorder.Output = file
+	}
+
+	if params.Stage != "" {
+		return harStage{HARRecorder: recorder, stage: params.Stage}, nil
+	}
+
+	return recorder, nil
+}
+
+var replayMatches = map[string]ReplayMatch{
+	"host":  ReplayMatchHost,
+	"query": ReplayMatchQuery,
+	"body":  ReplayMatchBody,
+}
+
+// newReplayer builds a Replayer answering requests from a HAR archive, from parameters such as
+// {"archive": "traffic.har", "match": ["host", "query"], "fallback": "notfound", "stage": "pre"}
+// Fallbacks are "notfound", "passthrough" and "nearest". Requests are compared as in DefaultReplayMatch if match is not set.
+func newReplayer(decode goxxy.Decoder) (interface{}, error) {
+	var params struct {
+		Archive  string    `json:"archive" yaml:"archive"`
+		Match    *[]string `json:"match" yaml:"match"`
+		Fallback string    `json:"fallback" yaml:"fallback"`
+		Stage    string    `json:"stage" yaml:"stage"`
+	}
+	if err := decode(&params); err != nil {
+		return nil, err
+	}
+
+	if params.Archive == "" {
+		return nil, fmt.Errorf("replay requires an archive")
+	}
+
+	file, err := os.Open(params.Archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	replayer, err := LoadReplayer(file)
+	if err != nil {
+		return nil, err
+	}
+	replayer.Stage = params.Stage
+
+	if params.Match != nil {
+		replayer.Match = 0
+		for _, name := range *params.Match {
+			match, exists := replayMatches[name]
+			if !exists {
+				return nil, fmt.Errorf("unknown replay match %q", name)
+			}
+			replayer.Match |= match
+		}
+	}
+
+	switch params.Fallback {
+	case "", "notfound":
+		replayer.Fallback = ReplayNotFound
+	case "passthrough":
+		replayer.Fallback = ReplayPassThrough
+	case "nearest":
+		replayer.Fallback = ReplayNearest
+	default:
+		return nil, fmt.Errorf("unknown replay fallback %q", params.Fallback)
+	}
+
+	return replayer, nil
+}
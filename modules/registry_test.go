@@ -0,0 +1,202 @@
+package modules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roob.re/goxxy"
+	"roob.re/goxxy/tests"
+	"strings"
+	"testing"
+)
+
+func jsonDecoder(params string) goxxy.Decoder {
+	return func(v interface{}) error {
+		return json.Unmarshal([]byte(params), v)
+	}
+}
+
+func TestRegexManglerFactory(t *testing.T) {
+	module, err := goxxy.NewModule("regex", jsonDecoder(`{"headers": [{"header": "Server", "search": "nginx", "replace": "goxxy"}], "body": [{"search": "foo", "replace": "bar"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := &http.Response{
+		Header: http.Header{"Server": {"nginx"}},
+		Body:   ioutil.NopCloser(strings.NewReader("foo foo")),
+	}
+	response = module.(goxxy.Mangler).Mangle(response)
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "bar bar" || response.Header.Get("Server") != "goxxy" {
+		t.Errorf("Unexpected response %q with headers %v", body, response.Header)
+	}
+
+	if _, err := goxxy.NewModule("regex", jsonDecoder(`{"body": [{"search": "("}]}`)); err == nil {
+		t.Error("Invalid regex did not return an error")
+	}
+}
+
+func TestRegexManglerFactoryRequest(t *testing.T) {
+	module, err := goxxy.NewModule("regex", jsonDecoder(`{"form": [{"field": "user", "search": ".+", "replace": "admin"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("user=guest&pass=1234"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	module.(goxxy.Middleware).Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "user=admin&pass=1234" {
+			t.Errorf("Unexpected request body %q", body)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	if _, err := goxxy.NewModule("regex", jsonDecoder(`{"json": [{"field": "user", "search": "("}]}`)); err == nil {
+		t.Error("Invalid regex did not return an error")
+	}
+}
+
+func TestHeaderChangerFactory(t *testing.T) {
+	module, err := goxxy.NewModule("headers", jsonDecoder(`{"-Server": "", "X-Test": "yes"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := &http.Response{Header: http.Header{"Server": {"nginx"}}}
+	module.(goxxy.Mangler).Mangle(response)
+	if response.Header.Get("Server") != "" || response.Header.Get("X-Test") != "yes" {
+		t.Errorf("Unexpected headers %v", response.Header)
+	}
+}
+
+func TestHeaderChangerFactoryValues(t *testing.T) {
+	module, err := goxxy.NewModule("headers", jsonDecoder(`{"~Set-Cookie": "^tracking=", "=Vary": "Cookie -> Origin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := &http.Response{Header: http.Header{
+		"Set-Cookie": {"tracking=1", "session=2"},
+		"Vary":       {"Cookie"},
+	}}
+	module.(goxxy.Mangler).Mangle(response)
+	if strings.Join(response.Header["Set-Cookie"], ", ") != "session=2" || response.Header.Get("Vary") != "Origin" {
+		t.Errorf("Unexpected headers %v", response.Header)
+	}
+
+	for _, params := range []string{`{"~Set-Cookie": "("}`, `{"=Vary": "Cookie"}`} {
+		if _, err := goxxy.NewModule("headers", jsonDecoder(params)); err == nil {
+			t.Errorf("Invalid parameters %s did not return an error", params)
+		}
+	}
+}
+
+func TestFormDumperFactorySharesOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := jsonDecoder(`{"output": "` + filepath.Join(dir, "forms.log") + `"}`)
+	first, err := goxxy.NewModule("formdumper", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := goxxy.NewModule("formdumper", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.(*FormDumper).Output != second.(*FormDumper).Output {
+		t.Error("Modules writing to the same path opened it twice")
+	}
+}
+
+func TestHARAndReplayFactories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "traffic.har")
+	module, err := goxxy.NewModule("har", jsonDecoder(`{"output": "`+archive+`", "stage": "pre"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := module.(harStage)
+	for _, path := range []string{"/first", "/second"} {
+		response := tests.GetResponse()
+		response.Request = httptest.NewRequest(http.MethodGet, "http://www.example.org"+path, nil)
+		recorded := recorder.Mangle(response)
+		ioutil.ReadAll(recorded.Body)
+		recorded.Body.Close()
+		if err := recorder.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	module, err = goxxy.NewModule("replay", jsonDecoder(`{"archive": "`+archive+`", "stage": "pre", "fallback": "passthrough"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := goxxy.New()
+	g.AddMiddleware(module.(goxxy.Middleware))
+	g.ErrHandler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+
+	for _, path := range []string{"/first", "/second"} {
+		if status, body := replay(t, g, http.MethodGet, "http://www.example.org"+path, ""); status != http.StatusOK || body != tests.ResponseHTML {
+			t.Errorf("Entry of every flushed archive was not replayed for %s: %d %s", path, status, body)
+		}
+	}
+
+	if status, _ := replay(t, g, http.MethodGet, "http://goxxy.invalid/third", ""); status != http.StatusTeapot {
+		t.Errorf("Unmatched request was not handled by the node: %d", status)
+	}
+
+	if _, err := goxxy.NewModule("replay", jsonDecoder(`{"archive": "`+archive+`", "match": ["path"]}`)); err == nil {
+		t.Error("Unknown match accepted")
+	}
+}
+
+func TestAccessLogFactoryUpdatesLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	first, err := goxxy.NewModule("accesslog", jsonDecoder(`{"output": "`+path+`", "maxSize": 1048576, "maxBackups": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := first.(*AccessLog).Output.(*RotatingFile)
+	defer output.Close()
+	output.Write([]byte("before reload\n"))
+
+	second, err := goxxy.NewModule("accesslog", jsonDecoder(`{"output": "`+path+`", "maxSize": 10, "maxBackups": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.(*AccessLog).Output != output {
+		t.Fatal("Modules writing to the same path opened it twice")
+	}
+
+	output.Write([]byte("after reload\n"))
+	if content, err := ioutil.ReadFile(path + ".1"); err != nil || string(content) != "before reload\n" {
+		t.Errorf("New MaxSize was not applied: %q, %v", content, err)
+	}
+}
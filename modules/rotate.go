@@ -0,0 +1,124 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	defaultRotateMaxSize    = 100 * 1024 * 1024
+	defaultRotateMaxBackups = 5
+)
+
+// RotatingFile is an io.Writer which appends to the file at Path, rotating it once it grows over MaxSize.
+// Rotated files are renamed to Path.1, Path.2 and so on, Path.1 being the most recent, and at most MaxBackups are kept.
+// The file is opened on the first write, and it is safe to use from several goroutines.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64 // Defaults to 100MiB
+	MaxBackups int   // Defaults to 5
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize() {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file and starts a new one, regardless of its size
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.rotate()
+}
+
+// Close closes the current file. It is opened again if there are more writes.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the backups, moves the current file to Path.1 and opens a new one. rf.mu must be held.
+func (rf *RotatingFile) rotate() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+
+	backups := rf.MaxBackups
+	if backups <= 0 {
+		backups = defaultRotateMaxBackups
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.Path, backups))
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.Path, i), fmt.Sprintf("%s.%d", rf.Path, i+1))
+	}
+
+	if err := os.Rename(rf.Path, rf.Path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return rf.open()
+}
+
+// setLimits changes MaxSize and MaxBackups while the file may be in use. They apply from the next write on, which
+// rotates the file if it is already over the new MaxSize.
+func (rf *RotatingFile) setLimits(maxSize int64, maxBackups int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.MaxSize, rf.MaxBackups = maxSize, maxBackups
+}
+
+func (rf *RotatingFile) maxSize() int64 {
+	if rf.MaxSize > 0 {
+		return rf.MaxSize
+	}
+	return defaultRotateMaxSize
+}
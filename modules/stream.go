@@ -0,0 +1,156 @@
+package modules // import "roob.re/goxxy/modules"
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"roob.re/goxxy"
+)
+
+const defaultStreamWindow = 4096
+
+// BodyTransformer is anything which can wrap a body with a reader that transforms its contents on the fly.
+// Transformers should read from body only as needed, so memory usage stays bounded regardless of the body size.
+type BodyTransformer interface {
+	TransformBody(body io.Reader) io.Reader
+}
+
+type BodyTransformerFunc func(body io.Reader) io.Reader
+
+func (f BodyTransformerFunc) TransformBody(body io.Reader) io.Reader {
+	return f(body)
+}
+
+// StreamMangler is a Mangler which applies BodyTransformers to the response body as it is being sent to the client.
+// Unlike modules which use CopyBody, the body is never read as a whole.
+type StreamMangler struct {
+	transformers []BodyTransformer
+}
+
+// AddTransformer appends a BodyTransformer to the chain. Transformers see the output of the ones added before them.
+func (s *StreamMangler) AddTransformer(t BodyTransformer) {
+	s.transformers = append(s.transformers, t)
+}
+
+// AddTransformerFunc appends a BodyTransformerFunc to the chain. Transformers see the output of the ones added before them.
+func (s *StreamMangler) AddTransformerFunc(t BodyTransformerFunc) {
+	s.transformers = append(s.transformers, t)
+}
+
+func (s *StreamMangler) Mangle(response *http.Response) *http.Response {
+	StreamBody(response, s.transformers...)
+	return response
+}
+
+// StreamBody wraps response.Body with the supplied transformers, without reading it.
+// As the final size of the body cannot be known in advance, Content-Length is removed from the response.
+// Responses which cannot have a body, such as those to HEAD requests or with a 204 or 304 status, are left untouched,
+// as their Content-Length describes the resource and not the message.
+func StreamBody(response *http.Response, transformers ...BodyTransformer) {
+	if len(transformers) == 0 || response.Body == nil || !goxxy.BodyAllowed(response) {
+		return
+	}
+
+	var body io.Reader = response.Body
+	for _, t := range transformers {
+		body = t.TransformBody(body)
+	}
+
+	response.Body = readCloser{Reader: body, Closer: response.Body}
+	response.ContentLength = -1
+	response.Header.Del("Content-Length")
+}
+
+// readCloser glues a transformed reader with the Closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// RegexTransformer returns a BodyTransformer which replaces every match of regex with replace, which can contain
+// submatch references as in regexp.Expand.
+// The stream is processed in chunks, holding back window bytes between them, so matches up to window bytes long are
+// guaranteed to be found even if they span several reads. A window of 0 uses a sensible default.
+// Anchors such as ^ and $ are evaluated against each chunk and not against the whole body.
+func RegexTransformer(regex *regexp.Regexp, replace string, window int) BodyTransformer {
+	if window <= 0 {
+		window = defaultStreamWindow
+	}
+
+	return BodyTransformerFunc(func(body io.Reader) io.Reader {
+		return &regexReader{
+			src:     body,
+			regex:   regex,
+			replace: []byte(replace),
+			window:  window,
+			chunk:   make([]byte, window),
+		}
+	})
+}
+
+type regexReader struct {
+	src     io.Reader
+	regex   *regexp.Regexp
+	replace []byte
+	window  int
+
+	chunk []byte // Scratch space for reads from src
+	in    []byte // Data read from src and not yet processed
+	out   []byte // Processed data not yet returned to the caller
+	err   error
+}
+
+func (rr *regexReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 && rr.err == nil {
+		// Keep at least two windows of data, so every process() call emits a meaningful amount of bytes
+		for len(rr.in) < 2*rr.window && rr.err == nil {
+			n, err := rr.src.Read(rr.chunk)
+			rr.in = append(rr.in, rr.chunk[:n]...)
+			rr.err = err
+		}
+
+		rr.process(rr.err != nil)
+	}
+
+	if len(rr.out) > 0 {
+		n := copy(p, rr.out)
+		rr.out = rr.out[n:]
+		return n, nil
+	}
+
+	return 0, rr.err
+}
+
+// process replaces the matches found in rr.in and moves the data which can no longer be part of a match to rr.out.
+// Unless final is true, the last window bytes are kept in rr.in, as they could be the prefix of a match.
+func (rr *regexReader) process(final bool) {
+	safe := len(rr.in)
+	if !final {
+		safe -= rr.window
+	}
+
+	if safe <= 0 {
+		return
+	}
+
+	out := make([]byte, 0, len(rr.in))
+	cursor := 0
+	for _, match := range rr.regex.FindAllSubmatchIndex(rr.in, -1) {
+		if match[0] >= safe {
+			break
+		}
+
+		out = append(out, rr.in[cursor:match[0]]...)
+		out = rr.regex.Expand(out, rr.replace, rr.in, match)
+		cursor = match[1]
+	}
+
+	end := safe
+	if cursor > end {
+		end = cursor
+	}
+	out = append(out, rr.in[cursor:end]...)
+
+	rr.out = out
+	rr.in = append(rr.in[:0], rr.in[end:]...)
+}
@@ -0,0 +1,93 @@
+package modules
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"roob.re/goxxy/tests"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRegexTransformer(t *testing.T) {
+	input := strings.Repeat("foo bar baz ", 1000)
+	regex := regexp.MustCompile(`b(a)r`)
+
+	for _, window := range []int{0, 3, 7, 64} {
+		reader := RegexTransformer(regex, "${1}X", window).TransformBody(iotest.OneByteReader(strings.NewReader(input)))
+		output, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := regex.ReplaceAllString(input, "${1}X"); string(output) != expected {
+			t.Errorf("Streamed replace with window %d differs from whole-body replace", window)
+		}
+	}
+}
+
+func TestStreamMangler(t *testing.T) {
+	sm := StreamMangler{}
+	sm.AddTransformer(RegexTransformer(regexp.MustCompile(`example\.org`), "roobre.es", 0))
+	sm.AddTransformerFunc(func(body io.Reader) io.Reader {
+		return io.MultiReader(body, strings.NewReader("<!-- goxxy -->"))
+	})
+
+	response := tests.GetResponse()
+	response.Header.Set("Content-Length", "1")
+	response = sm.Mangle(response)
+
+	if response.ContentLength != -1 || response.Header.Get("Content-Length") != "" {
+		t.Error("Content-Length was not removed from streamed response")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if strings.Contains(string(body), "example.org") || !strings.HasSuffix(string(body), "<!-- goxxy -->") {
+		t.Errorf("Transformers were not applied in order: %s", string(body))
+	}
+}
+
+func TestStreamBodyWithoutBody(t *testing.T) {
+	head := tests.GetResponse()
+	head.Request.Method = http.MethodHead
+	notModified := tests.GetResponse()
+	notModified.StatusCode = http.StatusNotModified
+	noContent := tests.GetResponse()
+	noContent.StatusCode = http.StatusNoContent
+
+	for _, response := range []*http.Response{head, notModified, noContent} {
+		response.ContentLength = 42
+		response.Header.Set("Content-Length", "42")
+
+		StreamBody(response, RegexTransformer(regexp.MustCompile(`example\.org`), "roobre.es", 0))
+		if response.ContentLength != 42 || response.Header.Get("Content-Length") != "42" {
+			t.Errorf("Content-Length was removed from bodyless %d response to %s", response.StatusCode, response.Request.Method)
+		}
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	response := &http.Response{Body: ioutil.NopCloser(strings.NewReader(tests.ResponseHTML)), ContentLength: -1}
+
+	if _, err := BufferBody(response, 10); err != ErrBodyTooLarge {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != tests.ResponseHTML {
+		t.Error("Body was not restored after exceeding the limit")
+	}
+
+	response.Body = ioutil.NopCloser(strings.NewReader(tests.ResponseHTML))
+	body, err := BufferBody(response, int64(len(tests.ResponseHTML)))
+	if err != nil || !bytes.Equal(body, []byte(tests.ResponseHTML)) {
+		t.Errorf("Body was not buffered: %v", err)
+	}
+
+	if again, _ := BufferBody(response, int64(len(tests.ResponseHTML))); &again[0] != &body[0] {
+		t.Error("Body was unnecessarily re-buffered")
+	}
+}
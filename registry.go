@@ -0,0 +1,121 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Decoder fills the value pointed by v with the parameters of a matcher or module, in the same fashion as json.Unmarshal.
+// It allows factories to be used with any serialization format.
+type Decoder func(v interface{}) error
+
+// MatcherFactory builds a Matcher from its parameters
+type MatcherFactory func(decode Decoder) (Matcher, error)
+
+// ModuleFactory builds a module from its parameters. The returned value must implement at least one of Middleware,
+// Mangler or FrameMangler.
+type ModuleFactory func(decode Decoder) (interface{}, error)
+
+var registry = struct {
+	mu          sync.RWMutex
+	matchers    map[string]MatcherFactory
+	modules     map[string]ModuleFactory
+	fileModules map[string]bool // Kinds registered with RegisterFileModule
+}{
+	matchers:    make(map[string]MatcherFactory),
+	modules:     make(map[string]ModuleFactory),
+	fileModules: make(map[string]bool),
+}
+
+// RegisterMatcher makes a kind of matcher available to be built by name, e.g. from the admin API.
+// Registering the same kind twice replaces the previous factory.
+func RegisterMatcher(kind string, factory MatcherFactory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.matchers[kind] = factory
+}
+
+// RegisterModule makes a kind of module available to be built by name, e.g. from the admin API.
+// Registering the same kind twice replaces the previous factory.
+func RegisterModule(kind string, factory ModuleFactory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.modules[kind] = factory
+	delete(registry.fileModules, kind)
+}
+
+// RegisterFileModule registers a kind of module as RegisterModule does, flagging it as reading or writing the files
+// named in its parameters. Such modules cannot be added through the admin API, as they would let its callers reach
+// any file the proxy can.
+func RegisterFileModule(kind string, factory ModuleFactory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.modules[kind] = factory
+	registry.fileModules[kind] = true
+}
+
+// IsFileModule returns true if kind was registered with RegisterFileModule
+func IsFileModule(kind string) bool {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return registry.fileModules[kind]
+}
+
+// NewMatcher builds a matcher of a registered kind
+func NewMatcher(kind string, decode Decoder) (Matcher, error) {
+	registry.mu.RLock()
+	factory, exists := registry.matchers[kind]
+	registry.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown matcher kind %q", kind)
+	}
+
+	return factory(decode)
+}
+
+// NewModule builds a module of a registered kind
+func NewModule(kind string, decode Decoder) (interface{}, error) {
+	registry.mu.RLock()
+	factory, exists := registry.modules[kind]
+	registry.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown module kind %q", kind)
+	}
+
+	return factory(decode)
+}
+
+// MatcherKinds returns the registered kinds of matchers, sorted by name
+func MatcherKinds() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	kinds := make([]string, 0, len(registry.matchers))
+	for kind := range registry.matchers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	return kinds
+}
+
+// ModuleKinds returns the registered kinds of modules, sorted by name
+func ModuleKinds() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	kinds := make([]string, 0, len(registry.modules))
+	for kind := range registry.modules {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	return kinds
+}
@@ -0,0 +1,252 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Server is an http.Server which also keeps track of the connections hijacked by Goxxy for CONNECT tunnels and
+// upgraded protocols, so they can be drained on Shutdown. http.Server forgets about connections once they are hijacked.
+// Intercepted CONNECT connections are served by their own http.Server, which is shut down along with Server, and
+// which closes them after IdleTimeout if it is set.
+// The embedded http.Server must not be started on its own, as connections would not be tracked.
+type Server struct {
+	http.Server
+
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	shutdown bool
+}
+
+// ListenAndServe listens on the TCP address s.Addr, or ":http" if empty, and serves connections from it
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections from listener and serves them, tracking hijacked ones.
+// As with http.Server, http.ErrServerClosed is returned after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.Server.Serve(&trackingListener{Listener: listener, server: s})
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting connections and waits, until ctx is done, for requests
+// being served to finish and for hijacked connections to be closed.
+// If ctx is done before, remaining connections are forcefully closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+
+	// Once http.Server is done, the only connections left are the hijacked ones
+	if err := s.Server.Shutdown(ctx); err != nil {
+		s.closeAll()
+		return err
+	}
+
+	// Intercepted connections are drained by the servers serving them, which close them once they are idle
+	var wg sync.WaitGroup
+	for _, inner := range s.innerServers() {
+		wg.Add(1)
+		go func(inner *http.Server) {
+			defer wg.Done()
+			inner.Shutdown(ctx)
+		}(inner)
+	}
+	wg.Wait()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.open() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.closeAll()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// open returns the number of tracked connections which are still open
+func (s *Server) open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// innerServers returns the servers serving intercepted connections which are still open
+func (s *Server) innerServers() []*http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []*http.Server
+	for conn := range s.conns {
+		if conn.inner != nil {
+			servers = append(servers, conn.inner)
+		}
+	}
+
+	return servers
+}
+
+// serveInner registers inner as the server for the intercepted connection conn, so it is shut down along with s.
+// Keep-alives are disabled if s is already shutting down, so the connection is closed after the request in flight.
+func (s *Server) serveInner(conn *trackedConn, inner *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.IdleTimeout > 0 {
+		inner.IdleTimeout = s.IdleTimeout
+	}
+	if s.shutdown {
+		inner.SetKeepAlivesEnabled(false)
+	}
+	conn.inner = inner
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// track registers a new connection. Connections accepted after Shutdown are closed right away.
+func (s *Server) track(conn *trackedConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) forget(conn *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+type trackingListener struct {
+	net.Listener
+	server *Server
+}
+
+func (tl *trackingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := tl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		tracked := &trackedConn{Conn: conn, server: tl.server}
+		if tl.server.track(tracked) {
+			return tracked, nil
+		}
+		conn.Close()
+	}
+}
+
+// trackedConn notifies the Server when it is closed
+type trackedConn struct {
+	net.Conn
+	server *Server
+	once   sync.Once
+	inner  *http.Server // Server for the requests of an intercepted CONNECT connection, if any. Guarded by server.mu.
+}
+
+func (tc *trackedConn) Close() error {
+	tc.once.Do(func() {
+		tc.server.forget(tc)
+	})
+	return tc.Conn.Close()
+}
+
+// Flusher is implemented by modules which buffer output, such as recorders, so it can be written out before exiting
+type Flusher interface {
+	Flush() error
+}
+
+// Flush calls Flush on every module of the tree rooted at g which implements Flusher. Modules added in several places,
+// e.g. as both Middleware and Mangler, are flushed once.
+// Every module is flushed even if some of them fail, and the first error found is returned.
+func (g *Goxxy) Flush() error {
+	return g.flush(make(map[interface{}]bool))
+}
+
+func (g *Goxxy) flush(flushed map[interface{}]bool) error {
+	var modules []interface{}
+	for _, mw := range g.Middlewares() {
+		modules = append(modules, mw)
+	}
+	for _, mg := range g.Manglers() {
+		// Conditional manglers are flushed through the mangler they wrap
+		if wrapper, isWrapper := mg.(interface{ Unwrap() Mangler }); isWrapper {
+			mg = wrapper.Unwrap()
+		}
+		modules = append(modules, mg)
+	}
+	for _, fm := range g.FrameManglers() {
+		modules = append(modules, fm)
+	}
+
+	var firstErr error
+	for _, module := range modules {
+		flusher, isFlusher := module.(Flusher)
+		if !isFlusher {
+			continue
+		}
+
+		// Modules such as maps cannot be used as keys, and cannot be told apart either
+		if reflect.TypeOf(module).Comparable() {
+			if flushed[module] {
+				continue
+			}
+			flushed[module] = true
+		}
+
+		if err := flusher.Flush(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error flushing %s: %v", ModuleName(module), err)
+		}
+	}
+
+	for _, child := range g.Children() {
+		if err := child.flush(flushed); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
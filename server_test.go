@@ -0,0 +1,213 @@
+package goxxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, handler http.Handler) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{}
+	server.Handler = handler
+	go server.Serve(listener)
+
+	return server, listener.Addr().String()
+}
+
+func TestServerDrainsRequests(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		rw.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	server, addr := startServer(t, New())
+
+	done := make(chan string)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr, nil)
+		req.Host = upstream.Listener.Addr().String()
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		done <- string(body)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("New connections accepted during shutdown")
+	}
+
+	close(release)
+	if body := <-done; body != "done" {
+		t.Errorf("Request in flight was not completed: %s", body)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Unexpected error shutting down: %v", err)
+	}
+}
+
+func TestServerClosesHijacked(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	server, addr := startServer(t, New())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Tunnel not established: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded with an open tunnel, got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Tunnel was not closed after the deadline")
+	}
+}
+
+type countingFlusher struct {
+	flushes int
+	err     error
+}
+
+func (cf *countingFlusher) Mangle(response *http.Response) *http.Response { return response }
+func (cf *countingFlusher) Middleware(handler http.Handler) http.Handler  { return handler }
+func (cf *countingFlusher) Flush() error {
+	cf.flushes++
+	return cf.err
+}
+
+func TestFlush(t *testing.T) {
+	shared := &countingFlusher{}
+	failing := &countingFlusher{err: fmt.Errorf("disk full")}
+
+	g := New()
+	g.AddModule(shared)
+	child := g.Child()
+	child.AddModule(failing)
+	child.AddMangler(shared)
+
+	err := g.Flush()
+	if err == nil || failing.flushes != 1 {
+		t.Error("Error flushing module not returned")
+	}
+
+	if shared.flushes != 1 {
+		t.Errorf("Module flushed %d times", shared.flushes)
+	}
+}
+
+func TestServerShutsDownIntercepted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("intercepted"))
+	}))
+	defer upstream.Close()
+
+	ca, err := GenerateCertAuthority("Goxxy test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := New()
+	g.CA = ca
+	server, addr := startServer(t, g)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	host := upstream.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	reader := bufio.NewReader(conn)
+	if response, err := http.ReadResponse(reader, nil); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Tunnel not established: %v", err)
+	}
+
+	// A keep-alive request leaves the intercepted connection idle, but open
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(response.Body); string(body) != "intercepted" {
+		t.Fatalf("Unexpected intercepted response: %s", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Unexpected error shutting down with an idle intercepted connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %s", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Intercepted connection was not closed")
+	}
+}
@@ -0,0 +1,111 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TraceOutput is a set of flags controlling where Goxxy reports how requests are routed through the tree.
+// They can be combined with |, and a value of 0 disables tracing.
+type TraceOutput uint8
+
+const (
+	TraceHeader TraceOutput = 1 << iota // Send the routing trace to the client in the X-Goxxy-Route response header
+	TraceLog                            // Log the routing trace of every request
+)
+
+// RouteHeader is the response header routing traces are sent in when TraceHeader is enabled
+const RouteHeader = "X-Goxxy-Route"
+
+// RouteTrace records the decisions taken while routing a request through a node and its children
+type RouteTrace struct {
+	Node     string         `json:"node"`               // Path of the node, as in RequestContext.NodePath
+	Disabled bool           `json:"disabled,omitempty"` // Disabled nodes are not evaluated
+	Skipped  bool           `json:"skipped,omitempty"`  // Skipped nodes are not evaluated, as a previous sibling matched first
+	Matchers []MatcherTrace `json:"matchers,omitempty"` // Matchers evaluated, in order. Evaluation stops at the first matching one.
+	Matched  bool           `json:"matched"`            // Whether the node matched. Nodes with no matchers match anything.
+	Handles  bool           `json:"handles,omitempty"`  // Set for the node which handles the request, the deepest matching one
+	Children []*RouteTrace  `json:"children,omitempty"` // Children of a matching node, in order
+}
+
+// MatcherTrace is the result of evaluating a matcher
+type MatcherTrace struct {
+	Matcher string `json:"matcher"`
+	Matched bool   `json:"matched"`
+}
+
+// Explain routes r through the tree rooted at g without serving it, and returns the decisions taken.
+// r is never sent upstream, so it can be a synthetic request built to find out which node would handle it.
+func (g *Goxxy) Explain(r *http.Request) *RouteTrace {
+	trace := &RouteTrace{Node: g.label(-1)}
+	g.route(r, trace.Node, trace)
+	return trace
+}
+
+// Handler returns the path of the node handling the request, or an empty string if nothing matched
+func (t *RouteTrace) Handler() string {
+	if t.Handles {
+		return t.Node
+	}
+
+	for _, child := range t.Children {
+		if handler := child.Handler(); handler != "" {
+			return handler
+		}
+	}
+
+	return ""
+}
+
+// String returns a single-line summary of the trace, with the evaluated nodes in order, such as
+// root: no matchers -> matched; root/api: host ~ "^api"=false -> no match; root/web: host ~ "^www"=true -> handles; root/other: skipped
+func (t *RouteTrace) String() string {
+	var entries []string
+	t.summarize(&entries)
+	return strings.Join(entries, "; ")
+}
+
+func (t *RouteTrace) summarize(entries *[]string) {
+	switch {
+	case t.Skipped:
+		*entries = append(*entries, t.Node+": skipped")
+		return
+	case t.Disabled:
+		*entries = append(*entries, t.Node+": disabled")
+		return
+	}
+
+	results := make([]string, 0, len(t.Matchers))
+	for _, m := range t.Matchers {
+		results = append(results, fmt.Sprintf("%s=%t", m.Matcher, m.Matched))
+	}
+	if len(results) == 0 {
+		results = append(results, "no matchers")
+	}
+
+	outcome := "no match"
+	switch {
+	case t.Handles:
+		outcome = "handles"
+	case t.Matched:
+		outcome = "matched"
+	}
+
+	*entries = append(*entries, t.Node+": "+strings.Join(results, ", ")+" -> "+outcome)
+	for _, child := range t.Children {
+		child.summarize(entries)
+	}
+}
+
+// reportTrace sends the routing trace of r to the outputs enabled in g.Trace
+func (g *Goxxy) reportTrace(rw http.ResponseWriter, r *http.Request, trace *RouteTrace) {
+	if g.Trace&TraceHeader != 0 {
+		rw.Header().Set(RouteHeader, trace.String())
+	}
+
+	if g.Trace&TraceLog != 0 {
+		log.Printf("Routed `%s`: %s", r.Method+" "+r.Host+r.RequestURI, trace)
+	}
+}
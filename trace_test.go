@@ -0,0 +1,94 @@
+package goxxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func traceTree() *Goxxy {
+	g := New()
+
+	api := g.Child()
+	api.Name = "api"
+	api.Match(HostMatcher("^api"))
+
+	web := g.Child()
+	web.Name = "web"
+	web.Match(HostMatcher("^nothing$"))
+	web.Match(HeaderMatcher("X-Web", "yes"))
+
+	web.Child() // Matches anything, so it shadows its parent
+
+	other := g.Child()
+	other.Name = "other"
+
+	return g
+}
+
+func TestExplain(t *testing.T) {
+	g := traceTree()
+
+	r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	r.Header.Set("X-Web", "yes")
+
+	trace := g.Explain(r)
+	if handler := trace.Handler(); handler != "root/web/0" {
+		t.Errorf("Unexpected handler %q", handler)
+	}
+
+	const expected = `root: no matchers -> matched; ` +
+		`root/api: host ~ "^api"=false -> no match; ` +
+		`root/web: host ~ "^nothing$"=false, header X-Web ~ "yes"=true -> matched; ` +
+		`root/web/0: no matchers -> handles; ` +
+		`root/other: skipped`
+	if trace.String() != expected {
+		t.Errorf("Unexpected trace:\n%s\nexpected:\n%s", trace, expected)
+	}
+
+	g.Children()[1].SetEnabled(false)
+	trace = g.Explain(r)
+	if handler := trace.Handler(); handler != "root/other" {
+		t.Errorf("Unexpected handler %q", handler)
+	}
+	if !trace.Children[1].Disabled || trace.Children[1].Matched {
+		t.Error("Disabled node was not reported")
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	g := traceTree()
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Header().Get(RouteHeader) != "" {
+		t.Error("Trace sent while disabled")
+	}
+
+	g.Trace = TraceHeader
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Header().Get(RouteHeader) != g.Explain(httptest.NewRequest(http.MethodGet, upstream.URL, nil)).String() {
+		t.Errorf("Unexpected trace header %q", rec.Header().Get(RouteHeader))
+	}
+}
+
+func TestAdminExplain(t *testing.T) {
+	admin := NewAdmin(traceTree())
+
+	rec := adminRequest(t, admin, http.MethodGet, "/explain?url=http://www.example.com/&header=X-Web:%20yes", "")
+	var trace RouteTrace
+	if err := json.Unmarshal(rec.Body.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	if trace.Handler() != "root/web/0" {
+		t.Errorf("Unexpected trace %s", rec.Body.String())
+	}
+
+	if rec := adminRequest(t, admin, http.MethodGet, "/explain", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Missing url returned %d", rec.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportConfig holds the settings a Goxxy uses to connect to upstream servers.
+// Each node owns a copy, and the http.Client built from it is not shared with other nodes.
+type TransportConfig struct {
+	Timeout               time.Duration  // Time limit for a whole exchange, including reading the response body. Zero means no limit.
+	FollowRedirects       bool           // Follow every redirect instead of sending the second one back to the client. See Goxxy.FollowRedirects.
+	InsecureSkipVerify    bool           // Do not verify certificates presented by upstream servers.
+	RootCAs               *x509.CertPool // Pool used to verify upstream certificates. If nil, the system pool is used.
+	MaxIdleConns          int            // Maximum number of idle connections across all hosts. Zero means no limit.
+	MaxIdleConnsPerHost   int            // Maximum number of idle connections per host. Zero means http.DefaultMaxIdleConnsPerHost.
+	IdleConnTimeout       time.Duration  // Time an idle connection is kept open. Zero means no limit.
+	DialTimeout           time.Duration  // Time limit to establish a TCP connection. Zero means no limit.
+	KeepAlive             time.Duration  // Interval between TCP keep-alive probes. Zero enables them with the system default.
+	TLSHandshakeTimeout   time.Duration  // Time limit for the TLS handshake. Zero means no limit.
+	ResponseHeaderTimeout time.Duration  // Time limit to receive the response headers after sending the request. Zero means no limit.
+	ParentProxy           *url.URL       // Proxy upstream traffic is sent through, see ParseParentProxy. If nil, the environment is honored as in http.ProxyFromEnvironment.
+}
+
+// DefaultTransportConfig holds the settings used by New
+var DefaultTransportConfig = TransportConfig{
+	Timeout:             8 * time.Second,
+	MaxIdleConns:        100,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         30 * time.Second,
+	KeepAlive:           30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// newClient builds an http.Client from the settings
+func (tc TransportConfig) newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: tc.DialTimeout, KeepAlive: tc.KeepAlive}
+
+	transport := &http.Transport{
+		Proxy:                 tc.proxyFunc(),
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify, RootCAs: tc.RootCAs},
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout,
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: tc.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{Timeout: tc.Timeout, CheckRedirect: tc.checkRedirect(), Transport: transport}
+}
+
+func (tc TransportConfig) checkRedirect() func(*http.Request, []*http.Request) error {
+	if tc.FollowRedirects {
+		return nil
+	}
+
+	return noRedirectsPolicy
+}
+
+// noRedirectsPolicy makes the client follow a single redirect, returning the next one instead of following it
+func noRedirectsPolicy(r *http.Request, rr []*http.Request) error {
+	if len(rr) > 1 {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// upstreamClient returns the client used to send requests upstream: g.Client if set, or one built from g.Transport.
+// The built client is cached until g.Transport changes, so connections are reused. When it changes, idle connections
+// of the previous client are closed, and those in use are closed as soon as they become idle.
+func (g *Goxxy) upstreamClient() *http.Client {
+	client, transport, _ := g.upstreamSettings()
+	if client != nil {
+		return client
+	}
+
+	g.clientMu.Lock()
+	defer g.clientMu.Unlock()
+
+	if g.client == nil || g.clientConfig != transport {
+		if g.client != nil {
+			closeIdleConnections(g.client)
+		}
+		g.client = transport.newClient()
+		g.clientConfig = transport
+	}
+
+	return g.client
+}
+
+// upstreamSettings returns g.Client, g.Transport and g.upstreams, which FollowRedirects and SetUpstreams can change
+// while requests are being served
+func (g *Goxxy) upstreamSettings() (*http.Client, TransportConfig, *upstreamPool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.Client, g.Transport, g.upstreams
+}
+
+// closeIdleConnections closes the idle connections of a client built by newClient
+func closeIdleConnections(client *http.Client) {
+	if transport, isTransport := client.Transport.(*http.Transport); isTransport {
+		transport.CloseIdleConnections()
+	}
+}
+
+// passthrough returns a Goxxy with the same upstream settings and client as g, but without any module.
+// It is used to forward requests which did not match any node, so they are sent with the settings of the node serving
+// them, usually the root, as no other node applies to them.
+func (g *Goxxy) passthrough() *Goxxy {
+	_, transport, upstreams := g.upstreamSettings()
+	return &Goxxy{
+		Client:       g.upstreamClient(),
+		Transport:    transport,
+		ErrHandler:   g.ErrHandler,
+		PreserveHost: g.PreserveHost,
+		Forwarding:   g.Forwarding,
+		ViaName:      g.ViaName,
+		Metrics:      g.Metrics,
+		upstreams:    upstreams,
+	}
+}
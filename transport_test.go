@@ -0,0 +1,175 @@
+package goxxy
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"roob.re/goxxy/tests"
+	"testing"
+	"time"
+)
+
+func TestTransportInheritance(t *testing.T) {
+	g := New()
+	child := g.Child()
+
+	child.Transport.Timeout = time.Minute
+	child.FollowRedirects(true)
+
+	if g.Transport.Timeout != DefaultTransportConfig.Timeout || g.Transport.FollowRedirects {
+		t.Error("Changes to the child transport leaked to the parent")
+	}
+
+	if g.upstreamClient() == child.upstreamClient() {
+		t.Error("Parent and child share the same client")
+	}
+
+	if child.upstreamClient().Timeout != time.Minute || child.upstreamClient().CheckRedirect != nil {
+		t.Error("Child client does not reflect its transport settings")
+	}
+
+	client := g.upstreamClient()
+	if g.upstreamClient() != client {
+		t.Error("Client was rebuilt without changes to the transport settings")
+	}
+
+	g.Transport.MaxIdleConnsPerHost = 4
+	if g.upstreamClient() == client {
+		t.Error("Client was not rebuilt after changing the transport settings")
+	}
+}
+
+func TestFollowRedirectsSharedClient(t *testing.T) {
+	shared := &http.Client{CheckRedirect: noRedirectsPolicy}
+
+	g := New()
+	g.Client = shared
+	child := g.Child()
+	child.FollowRedirects(true)
+
+	if shared.CheckRedirect == nil || g.Client.CheckRedirect == nil {
+		t.Error("FollowRedirects modified a shared client")
+	}
+
+	if child.Client == shared || child.Client.CheckRedirect != nil {
+		t.Error("FollowRedirects did not apply to the child")
+	}
+}
+
+func TestTransportRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/older", func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "/old", http.StatusFound)
+	})
+	mux.HandleFunc("/old", func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", tests.HTMLHandler)
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	g := New()
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL+"/old", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Single redirect was not followed by default, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL+"/older", nil))
+	if rec.Code != http.StatusFound {
+		t.Errorf("Second redirect was followed by default, got %d", rec.Code)
+	}
+
+	g.FollowRedirects(true)
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL+"/older", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Redirects were not followed, got %d", rec.Code)
+	}
+}
+
+func TestUpstreamSettingsWhileServing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(tests.HTMLHandler))
+	defer upstream.Close()
+
+	g := New()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			g.FollowRedirects(i%2 == 0)
+			g.SetUpstreams(upstream.URL)
+			g.Child()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	}
+	<-done
+}
+
+func TestTransportTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(tests.HTMLHandler))
+	defer upstream.Close()
+
+	g := New()
+	g.ErrHandler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	})
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Error("Untrusted certificate was accepted")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	g.Transport.RootCAs = pool
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Certificate from custom pool was rejected, got %d", rec.Code)
+	}
+
+	g.Transport.RootCAs = nil
+	g.Transport.InsecureSkipVerify = true
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, upstream.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("InsecureSkipVerify did not skip verification, got %d", rec.Code)
+	}
+}
+
+func TestTransportChangeClosesIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(tests.HTMLHandler))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	g := New()
+	response, err := g.upstreamClient().Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	g.Transport.Timeout = time.Minute
+	g.upstreamClient()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Idle connection of the previous client was not closed")
+	}
+}
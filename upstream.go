@@ -0,0 +1,108 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// upstreamPool is a fixed list of upstream base URLs, which are used in a round-robin fashion
+type upstreamPool struct {
+	targets []*url.URL
+	next    uint32
+}
+
+func newUpstreamPool(rawurls []string) (*upstreamPool, error) {
+	pool := &upstreamPool{}
+	for _, rawurl := range rawurls {
+		target, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return nil, errors.New("upstream must be an absolute http or https URL: " + rawurl)
+		}
+
+		pool.targets = append(pool.targets, target)
+	}
+
+	return pool, nil
+}
+
+// pick returns the next upstream in the list
+func (p *upstreamPool) pick() *url.URL {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return p.targets[n%uint32(len(p.targets))]
+}
+
+// SetUpstreams turns g into a reverse proxy: matched requests will be sent to one of the supplied base URLs instead of
+// the host they were addressed to. If more than one URL is given, they are used in turns.
+// The path of the request is appended to the path of the base URL. Children created afterwards inherit the upstreams.
+// Calling SetUpstreams without arguments restores the forward proxy behavior.
+func (g *Goxxy) SetUpstreams(rawurls ...string) error {
+	var pool *upstreamPool
+	if len(rawurls) > 0 {
+		var err error
+		if pool, err = newUpstreamPool(rawurls); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	g.upstreams = pool
+	g.mu.Unlock()
+
+	return nil
+}
+
+// upstreamURL returns the URL the request should be sent to, along with the value of the Host header
+func (g *Goxxy) upstreamURL(r *http.Request) (*url.URL, string) {
+	if _, _, upstreams := g.upstreamSettings(); upstreams != nil {
+		target := upstreams.pick()
+		u := *target
+		// Both paths are kept so encoded characters, such as %2F, reach the upstream as the client sent them
+		u.Path = joinPaths(target.Path, r.URL.Path)
+		u.RawPath = joinPaths(target.EscapedPath(), r.URL.EscapedPath())
+		if target.RawQuery == "" || r.URL.RawQuery == "" {
+			u.RawQuery = target.RawQuery + r.URL.RawQuery
+		} else {
+			u.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+		}
+
+		if g.PreserveHost {
+			return &u, r.Host
+		}
+		return &u, u.Host
+	}
+
+	// Requests sent to a forward proxy carry the absolute URL
+	if r.URL.IsAbs() {
+		u := *r.URL
+		return &u, r.Host
+	}
+
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	return u, r.Host
+}
+
+func joinPaths(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+
+	return a + b
+}
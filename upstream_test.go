@@ -0,0 +1,100 @@
+package goxxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJoinPaths(t *testing.T) {
+	cases := map[[2]string]string{
+		{"", "/a"}:       "/a",
+		{"/base", ""}:    "/base",
+		{"/base/", "/a"}: "/base/a",
+		{"/base", "/a"}:  "/base/a",
+		{"/base", "a"}:   "/base/a",
+	}
+
+	for paths, expected := range cases {
+		if joined := joinPaths(paths[0], paths[1]); joined != expected {
+			t.Errorf("joinPaths(%q, %q) = %q, expected %q", paths[0], paths[1], joined, expected)
+		}
+	}
+}
+
+func TestSetUpstreams(t *testing.T) {
+	g := New()
+
+	if err := g.SetUpstreams("not a url"); err == nil {
+		t.Error("Relative URL accepted as upstream")
+	}
+
+	if err := g.SetUpstreams("ftp://example.org"); err == nil {
+		t.Error("Non-http URL accepted as upstream")
+	}
+
+	if err := g.SetUpstreams("http://one.example/base?fixed=1", "https://two.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	child := g.Child()
+	req, _ := http.NewRequest(http.MethodGet, "/path?q=1", nil)
+	req.Host = "frontend.example"
+
+	u, host := child.upstreamURL(req)
+	if u.String() != "http://one.example/base/path?fixed=1&q=1" || host != "one.example" {
+		t.Errorf("Unexpected first upstream %s with host %s", u, host)
+	}
+
+	child.PreserveHost = true
+	u, host = child.upstreamURL(req)
+	if u.String() != "https://two.example/path?q=1" || host != "frontend.example" {
+		t.Errorf("Unexpected second upstream %s with host %s", u, host)
+	}
+
+	g.SetUpstreams()
+	if u, _ = g.upstreamURL(req); u.String() != "http://frontend.example/path?q=1" {
+		t.Errorf("Unexpected forward URL %s", u)
+	}
+}
+
+func TestUpstreamEncodedPath(t *testing.T) {
+	g := New()
+	if err := g.SetUpstreams("http://upstream.example/base%2Fdir"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/a%2Fb/c", nil)
+	u, _ := g.upstreamURL(req)
+	if u.EscapedPath() != "/base%2Fdir/a%2Fb/c" || u.Path != "/base/dir/a/b/c" {
+		t.Errorf("Encoded path was not preserved: %s (%s)", u.EscapedPath(), u.Path)
+	}
+
+	forward, _ := New().upstreamURL(req)
+	if forward.EscapedPath() != "/a%2Fb/c" {
+		t.Errorf("Forward and reverse paths are encoded differently: %s", forward.EscapedPath())
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Host + r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	g := New()
+	g.SetUpstreams(upstream.URL + "/app")
+	g.PreserveHost = true
+
+	req := httptest.NewRequest(http.MethodGet, "/index.html?lang=en", nil)
+	req.Host = "frontend.example"
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	if !bytes.Equal(body, []byte("frontend.example/app/index.html?lang=en")) {
+		t.Errorf("Request was not sent to the upstream: %s", body)
+	}
+}
@@ -0,0 +1,407 @@
+package goxxy // import "roob.re/goxxy"
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket message types, as defined in RFC 6455
+const (
+	WebSocketText   = 1
+	WebSocketBinary = 2
+)
+
+const (
+	wsOpContinuation = 0
+	wsOpBinary       = 2
+	wsOpClose        = 8
+	wsOpPong         = 10
+
+	wsCloseProtocolError = 1002
+
+	maxWebSocketMessage = 64 * 1024 * 1024
+)
+
+var errWebSocketMessageTooLarge = errors.New("websocket message too large")
+
+// wsProtocolError is returned when a peer violates RFC 6455, in which case the connection is failed with a 1002 close code
+type wsProtocolError string
+
+func (e wsProtocolError) Error() string {
+	return "websocket protocol error: " + string(e)
+}
+
+// WebSocketMessage is a text or binary message relayed through an upgraded connection.
+// Fragmented messages are reassembled before being handed to FrameManglers.
+type WebSocketMessage struct {
+	Type       int           // Either WebSocketText or WebSocketBinary
+	Data       []byte        // Unmasked payload of the message
+	FromClient bool          // Direction of the message. Messages with FromClient set to true are sent to the server, and to the client otherwise.
+	Request    *http.Request // Request which initiated the upgrade
+}
+
+// FrameMangler is the WebSocket equivalent of Mangler. It receives every text and binary message relayed through an
+// upgraded connection, and returns the messages which will be sent in its place, in order.
+// Returning the same message forwards it, returning nil drops it, and returning more messages injects them. Injected
+// messages can be sent to the opposite peer by flipping their FromClient field.
+// Control frames (ping, pong and close) are always forwarded untouched, and returned messages whose Type is not
+// WebSocketText or WebSocketBinary are logged and dropped.
+type FrameMangler interface {
+	MangleFrame(message *WebSocketMessage) []*WebSocketMessage
+}
+type FrameManglerFunc func(message *WebSocketMessage) []*WebSocketMessage
+
+func (fmf FrameManglerFunc) MangleFrame(message *WebSocketMessage) []*WebSocketMessage {
+	return fmf(message)
+}
+
+// isUpgrade returns true if the headers request a protocol upgrade, as in RFC 7230, section 6.7
+func isUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && header.Get("Upgrade") != ""
+}
+
+// headerHasToken returns true if token is present in any of the comma-separated values of the header
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyUpgrade relays a request which asks for a protocol upgrade. If upstream agrees, the client connection is
+// hijacked and data is relayed in both directions, through g.frameManglers if the new protocol is WebSocket.
+func (g *Goxxy) proxyUpgrade(rw http.ResponseWriter, r *http.Request) {
+	hijacker, isHijacker := rw.(http.Hijacker)
+	if !isHijacker {
+		http.Error(rw, "Upgrade not supported by this server", http.StatusNotImplemented)
+		return
+	}
+
+	upgrade := r.Header.Get("Upgrade")
+	websocket := strings.EqualFold(upgrade, "websocket")
+
+	g.mu.RLock()
+	frameManglers := g.frameManglers
+	g.mu.RUnlock()
+
+	// upstreamRequest removes hop-by-hop headers, so the upgrade must be requested again
+	newreq := g.upstreamRequest(r)
+	newreq.Header.Set("Connection", "Upgrade")
+	newreq.Header.Set("Upgrade", upgrade)
+	if websocket && len(frameManglers) > 0 {
+		// Compressed frames cannot be mangled, so make sure compression is not negotiated
+		newreq.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	// http.Client.Timeout would kill the upgraded connection, so the transport is used directly
+	transport := g.upstreamClient().Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	rc := FromRequest(r)
+	if rc != nil {
+		rc.UpstreamStart = time.Now()
+	}
+
+	response, err := transport.RoundTrip(newreq)
+	if rc != nil {
+		rc.UpstreamEnd = time.Now()
+	}
+	g.Metrics.observeUpstream(rc, err)
+	if err != nil {
+		g.upstreamError(rw, r, err)
+		return
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		g.respond(rw, response)
+		return
+	}
+
+	upgraded := response.Header.Get("Upgrade")
+	g.prepareResponse(response)
+	response.Header.Set("Connection", "Upgrade")
+	response.Header.Set("Upgrade", upgraded)
+
+	// Bodies of 101 responses are writable since Go 1.12. Older versions cannot relay upgraded connections.
+	upstream, isRWC := response.Body.(io.ReadWriteCloser)
+	if !isRWC {
+		response.Body.Close()
+		http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("error hijacking upgraded request: %v", err)
+		return
+	}
+	client := &bufferedConn{Conn: conn, reader: buffered.Reader}
+	defer client.Close()
+
+	if _, err := fmt.Fprintf(client, "HTTP/1.1 %s\r\n", response.Status); err != nil {
+		return
+	}
+	if err := response.Header.Write(client); err != nil {
+		return
+	}
+	if _, err := io.WriteString(client, "\r\n"); err != nil {
+		return
+	}
+	if rc != nil {
+		rc.Status = response.StatusCode
+	}
+
+	if !websocket || len(frameManglers) == 0 {
+		tunnel(client, upstream)
+		return
+	}
+
+	relay := &wsRelay{
+		request:  r,
+		manglers: frameManglers,
+		client:   &wsConn{rwc: client, reader: bufio.NewReader(client)},
+		server:   &wsConn{rwc: upstream, reader: bufio.NewReader(upstream), masked: true},
+	}
+	relay.run()
+}
+
+// wsRelay relays WebSocket frames between the client and the server, passing messages through FrameManglers
+type wsRelay struct {
+	request  *http.Request
+	manglers []FrameMangler
+	client   *wsConn
+	server   *wsConn
+}
+
+func (relay *wsRelay) run() {
+	done := make(chan struct{}, 2)
+	pipe := func(src *wsConn, fromClient bool) {
+		err := relay.pipe(src, fromClient)
+		if err != nil && err != io.EOF {
+			log.Printf("error relaying websocket frames: %v", err)
+		}
+		if _, isProtocolError := err.(wsProtocolError); isProtocolError {
+			relay.fail(wsCloseProtocolError)
+		}
+		relay.client.rwc.Close()
+		relay.server.rwc.Close()
+		done <- struct{}{}
+	}
+
+	go pipe(relay.client, true)
+	go pipe(relay.server, false)
+
+	<-done
+	<-done
+}
+
+// fail sends a close frame with the given status code to both peers, as required to fail the connection
+func (relay *wsRelay) fail(code uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	relay.client.writeFrame(wsOpClose, payload[:])
+	relay.server.writeFrame(wsOpClose, payload[:])
+}
+
+// pipe reads frames from src until it fails, reassembling and mangling data messages
+func (relay *wsRelay) pipe(src *wsConn, fromClient bool) error {
+	var message *WebSocketMessage
+
+	for {
+		frame, err := src.readFrame()
+		if err != nil {
+			return err
+		}
+
+		// Control frames can be interleaved with fragments, and are forwarded right away
+		if frame.opcode >= wsOpClose {
+			if err := relay.peer(fromClient).writeFrame(frame.opcode, frame.payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if message == nil {
+			if frame.opcode == wsOpContinuation {
+				return wsProtocolError("continuation frame without a message")
+			}
+			message = &WebSocketMessage{Type: int(frame.opcode), FromClient: fromClient, Request: relay.request}
+		}
+
+		if len(message.Data)+len(frame.payload) > maxWebSocketMessage {
+			return errWebSocketMessageTooLarge
+		}
+		message.Data = append(message.Data, frame.payload...)
+
+		if !frame.fin {
+			continue
+		}
+
+		for _, m := range relay.mangle(message) {
+			if m.Type != WebSocketText && m.Type != WebSocketBinary {
+				log.Printf("dropping websocket message of invalid type %d returned by a FrameMangler", m.Type)
+				continue
+			}
+
+			if err := relay.peer(m.FromClient).writeFrame(byte(m.Type), m.Data); err != nil {
+				return err
+			}
+		}
+		message = nil
+	}
+}
+
+// mangle passes the message through every FrameMangler, each of them receiving the output of the previous one
+func (relay *wsRelay) mangle(message *WebSocketMessage) []*WebSocketMessage {
+	messages := []*WebSocketMessage{message}
+	for _, mangler := range relay.manglers {
+		var mangled []*WebSocketMessage
+		for _, m := range messages {
+			mangled = append(mangled, mangler.MangleFrame(m)...)
+		}
+		messages = mangled
+	}
+
+	return messages
+}
+
+// peer returns the connection messages with the given direction should be written to
+func (relay *wsRelay) peer(fromClient bool) *wsConn {
+	if fromClient {
+		return relay.server
+	}
+	return relay.client
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// wsConn reads and writes WebSocket frames. Writes are serialized, as both directions may inject frames into it.
+type wsConn struct {
+	rwc    io.ReadWriteCloser
+	reader *bufio.Reader
+	masked bool // Frames sent by clients must be masked
+
+	mu sync.Mutex
+}
+
+func (c *wsConn) readFrame() (*wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	if header[0]&0x70 != 0 {
+		return nil, wsProtocolError("frame uses unsupported extensions")
+	}
+	if (frame.opcode > wsOpBinary && frame.opcode < wsOpClose) || frame.opcode > wsOpPong {
+		return nil, wsProtocolError(fmt.Sprintf("reserved opcode %#x", frame.opcode))
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if length > maxWebSocketMessage {
+		return nil, errWebSocketMessageTooLarge
+	}
+
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, frame.payload); err != nil {
+		return nil, err
+	}
+
+	if masked {
+		maskBytes(mask, frame.payload)
+	}
+
+	return frame, nil
+}
+
+// writeFrame writes a single, final frame with the given payload, masking it if needed
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.masked {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(length))
+	}
+
+	if c.masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.rwc.Write(frame)
+	return err
+}
+
+func maskBytes(mask [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,203 @@
+package goxxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// wsEchoHandler accepts WebSocket handshakes and echoes every frame back to the client
+func wsEchoHandler(rw http.ResponseWriter, r *http.Request) {
+	if !isUpgrade(r.Header) {
+		rw.Write([]byte("not upgraded"))
+		return
+	}
+
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	conn, buffered, _ := rw.(http.Hijacker).Hijack()
+	defer conn.Close()
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n")
+	buffered.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	buffered.Flush()
+
+	ws := &wsConn{rwc: conn, reader: buffered.Reader}
+	for {
+		frame, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+
+		ws.writeFrame(frame.opcode, frame.payload)
+		if frame.opcode == wsOpClose {
+			return
+		}
+	}
+}
+
+// dialWebSocket performs a WebSocket handshake with upstream through the proxy
+func dialWebSocket(t *testing.T, proxy, upstream string) *wsConn {
+	proxyURL, _ := url.Parse(proxy)
+	upstreamURL, _ := url.Parse(upstream)
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + upstreamURL.Host + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake failed with status %d", response.StatusCode)
+	}
+
+	return &wsConn{rwc: conn, reader: reader, masked: true}
+}
+
+func readMessage(t *testing.T, ws *wsConn) string {
+	frame, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(frame.payload)
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(wsEchoHandler))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(New())
+	defer proxy.Close()
+
+	ws := dialWebSocket(t, proxy.URL, upstream.URL)
+	defer ws.rwc.Close()
+
+	ws.writeFrame(WebSocketText, []byte("hewwo"))
+	if message := readMessage(t, ws); message != "hewwo" {
+		t.Errorf("Unexpected echo: %s", message)
+	}
+}
+
+func TestFrameMangler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(wsEchoHandler))
+	defer upstream.Close()
+
+	g := New()
+	g.AddFrameManglerFunc(func(message *WebSocketMessage) []*WebSocketMessage {
+		if !message.FromClient {
+			return []*WebSocketMessage{message}
+		}
+
+		switch string(message.Data) {
+		case "drop":
+			return nil
+		case "inject":
+			return []*WebSocketMessage{message, {Type: WebSocketText, Data: []byte("injected")}}
+		}
+
+		message.Data = bytes.ToUpper(message.Data)
+		return []*WebSocketMessage{message}
+	})
+
+	proxy := httptest.NewServer(g)
+	defer proxy.Close()
+
+	ws := dialWebSocket(t, proxy.URL, upstream.URL)
+	defer ws.rwc.Close()
+
+	ws.writeFrame(WebSocketText, []byte("hewwo"))
+	if message := readMessage(t, ws); message != "HEWWO" {
+		t.Errorf("Message was not mangled: %s", message)
+	}
+
+	ws.writeFrame(WebSocketText, []byte("drop"))
+	ws.writeFrame(WebSocketText, []byte("after"))
+	if message := readMessage(t, ws); message != "AFTER" {
+		t.Errorf("Message was not dropped: %s", message)
+	}
+
+	ws.writeFrame(WebSocketText, []byte("inject"))
+	received := map[string]bool{readMessage(t, ws): true, readMessage(t, ws): true}
+	if !received["inject"] || !received["injected"] {
+		t.Errorf("Message was not injected: %v", received)
+	}
+
+	// Fragmented messages are reassembled before mangling
+	ws.rwc.Write([]byte{0x01, 0x80 | 3, 0, 0, 0, 0, 'f', 'r', 'a'})
+	ws.rwc.Write([]byte{0x80, 0x80 | 5, 0, 0, 0, 0, 'g', 'm', 'e', 'n', 't'})
+	if message := readMessage(t, ws); message != "FRAGMENT" {
+		t.Errorf("Fragmented message was not reassembled: %s", message)
+	}
+}
+
+func TestWebSocketReservedOpcode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(wsEchoHandler))
+	defer upstream.Close()
+
+	g := New()
+	g.AddFrameManglerFunc(func(message *WebSocketMessage) []*WebSocketMessage {
+		return []*WebSocketMessage{message}
+	})
+
+	proxy := httptest.NewServer(g)
+	defer proxy.Close()
+
+	ws := dialWebSocket(t, proxy.URL, upstream.URL)
+	defer ws.rwc.Close()
+
+	ws.writeFrame(0x3, []byte("reserved"))
+	frame, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.opcode != wsOpClose || len(frame.payload) != 2 || binary.BigEndian.Uint16(frame.payload) != wsCloseProtocolError {
+		t.Errorf("Connection was not failed with a protocol error: opcode %d, payload %v", frame.opcode, frame.payload)
+	}
+}
+
+func TestFrameManglerInvalidType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(wsEchoHandler))
+	defer upstream.Close()
+
+	g := New()
+	g.AddFrameManglerFunc(func(message *WebSocketMessage) []*WebSocketMessage {
+		if !message.FromClient || string(message.Data) != "invalid" {
+			return []*WebSocketMessage{message}
+		}
+
+		return []*WebSocketMessage{{Type: wsOpClose, Data: message.Data}, {Type: 0x3, Data: message.Data}}
+	})
+
+	proxy := httptest.NewServer(g)
+	defer proxy.Close()
+
+	ws := dialWebSocket(t, proxy.URL, upstream.URL)
+	defer ws.rwc.Close()
+
+	ws.writeFrame(WebSocketText, []byte("invalid"))
+	ws.writeFrame(WebSocketText, []byte("after"))
+	frame, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.opcode != WebSocketText || string(frame.payload) != "after" {
+		t.Errorf("Messages of invalid type were not dropped: opcode %d, payload %s", frame.opcode, frame.payload)
+	}
+}